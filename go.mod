@@ -3,14 +3,19 @@ module lazydeus/CryptoMassTest
 go 1.20
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358
+	github.com/BurntSushi/toml v1.4.0
 	github.com/Demetrous-fd/CryptoPro-Adapter v0.0.0-20241106012201-8e2485214934
 	github.com/google/uuid v1.6.0
 	github.com/otiai10/copy v1.14.0
+	go.mozilla.org/pkcs7 v0.9.0
 	golang.org/x/exp v0.0.0-20240719175910-8a7402abbf56
-	golang.org/x/sys v0.5.0
+	golang.org/x/sys v0.13.0
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 )
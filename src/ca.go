@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	CATypeCertsrv = "certsrv"
+	CATypeEST     = "est"
+	CATypeSCEP    = "scep"
+	CATypeLocal   = "local"
+)
+
+type CAStatus string
+
+const (
+	CAStatusIssued  CAStatus = "issued"
+	CAStatusPending CAStatus = "pending"
+	CAStatusDenied  CAStatus = "denied"
+	CAStatusUnknown CAStatus = "unknown"
+)
+
+var (
+	ErrNotSupported       = errors.New("not supported by the CA backend")
+	ErrRequestIdNotFound  = errors.New("request id not found")
+	ErrCertificateMissing = errors.New("certificate not found in CA response")
+)
+
+// CAError is a request rejected or not processed by the CA,
+// Disposition and HResult are taken from the CA response as is.
+type CAError struct {
+	RequestId   string   `json:"requestId,omitempty"`
+	Status      CAStatus `json:"status,omitempty"`
+	Disposition string   `json:"disposition,omitempty"`
+	HResult     string   `json:"hresult,omitempty"`
+}
+
+func (e *CAError) Error() string {
+	message := fmt.Sprintf("request status: %s", e.Status)
+	if e.RequestId != "" {
+		message = fmt.Sprintf("request[%s] status: %s", e.RequestId, e.Status)
+	}
+	if e.Disposition != "" {
+		message += fmt.Sprintf(", disposition: %s", e.Disposition)
+	}
+	if e.HResult != "" {
+		message += fmt.Sprintf(", hresult: %s", e.HResult)
+		if name, ok := CERTSRV_HRESULT_NAMES[e.HResult]; ok {
+			message += fmt.Sprintf(" (%s)", name)
+		}
+	}
+	return message
+}
+
+// CARequest describes a request submitted to a CA.
+// Certificate is filled when the backend returns the certificate right away.
+type CARequest struct {
+	Id          string
+	Status      CAStatus
+	Certificate string
+	Attempts    int
+}
+
+// CA is a certificate authority backend used by the csr pipeline.
+// Certificates are returned in base64 (PEM) form, as installCertificate expects.
+type CA interface {
+	Submit(csr string) (*CARequest, error)
+	Status(requestId string) (CAStatus, error)
+	Certificate(requestId string) (string, error)
+	Root() (string, error)
+	Chain() (string, error)
+}
+
+// AttributeSubmitter is implemented by backends that accept request attributes
+// (CertificateTemplate, SAN, ValidityPeriod) in "Name:Value" form next to the csr.
+type AttributeSubmitter interface {
+	SubmitWithAttributes(csr string, attributes []string) (*CARequest, error)
+}
+
+// Reenroller is implemented by backends that distinguish re-enrollment of an existing certificate.
+type Reenroller interface {
+	Reenroll(csr string) (*CARequest, error)
+}
+
+// PendingRestorer is implemented by backends that keep pending requests only in memory.
+// resume restores the request from the csr saved next to the container before checking its status.
+type PendingRestorer interface {
+	RestorePending(requestId string, csr string) error
+}
+
+// SessionPending is implemented by backends whose pending requests can be checked only during the run.
+// A request still pending after params.PendingTimeout is failed, so its container is not kept for resume.
+type SessionPending interface {
+	SessionPending()
+}
+
+// reenrollCA submits requests through Reenroll, renew uses it for backends that implement Reenroller.
+type reenrollCA struct {
+	CA
+	reenroller Reenroller
+}
+
+func (ca *reenrollCA) Submit(csr string) (*CARequest, error) {
+	return ca.reenroller.Reenroll(csr)
+}
+
+// renewCA returns the CA used to renew certificates, re-enrollment when the backend supports it.
+func renewCA(ca CA) CA {
+	if reenroller, ok := ca.(Reenroller); ok {
+		return &reenrollCA{CA: ca, reenroller: reenroller}
+	}
+	return ca
+}
+
+func NewCA(cadesObj *cades.Cades, params *CAParams) (CA, error) {
+	caType := CATypeCertsrv
+	if params.Type != nil && *params.Type != "" {
+		caType = *params.Type
+	}
+
+	switch caType {
+	case CATypeCertsrv:
+		return NewCertsrvCA(params)
+	case CATypeEST:
+		return NewESTCA(params)
+	case CATypeSCEP:
+		return NewSCEPCA(params)
+	case CATypeLocal:
+		return NewLocalCA(cadesObj, params)
+	default:
+		return nil, fmt.Errorf("unknown CA type: %s", caType)
+	}
+}
+
+// requestCertificate submits csr and waits for the certificate, name is used in retry logs.
+// Returned request is never nil, Attempts holds the number of submit attempts plus retries while polling.
+func requestCertificate(ca CA, name string, csr string, attributes []string, params *CAParams) (*CARequest, error) {
+	submit := ca.Submit
+	if len(attributes) > 0 {
+		if submitter, ok := ca.(AttributeSubmitter); ok {
+			submit = func(csr string) (*CARequest, error) {
+				return submitter.SubmitWithAttributes(csr, attributes)
+			}
+		} else {
+			slog.Warn(fmt.Sprintf("Request attributes are %s, %s", ErrNotSupported.Error(), name))
+		}
+	}
+
+	var request *CARequest
+	attempts, err := withRetryIf(&params.Retry, name, isSubmitRetryable, func() error {
+		var err error
+		request, err = submit(csr)
+		return err
+	})
+	if err != nil {
+		if isRetryable(err) && !isSubmitRetryable(err) {
+			slog.Warn(fmt.Sprintf("Request is not sent again, the CA may have already received it, check the CA before the next run, %s", name))
+		}
+		return &CARequest{Status: CAStatusUnknown, Attempts: attempts}, err
+	}
+	request.Attempts = attempts
+
+	request, err = waitCertificate(ca, name, request, params)
+	if err == nil && request.Status == CAStatusPending {
+		if _, ok := ca.(SessionPending); ok {
+			return request, &CAError{
+				RequestId:   request.Id,
+				Status:      CAStatusUnknown,
+				Disposition: "still pending at the end of pendingTimeout, the request cannot be resumed later",
+			}
+		}
+	}
+	return request, err
+}
+
+// waitCertificate polls a pending request until it is resolved or params.PendingTimeout expires.
+// A request that is still pending after the timeout is returned without an error.
+func waitCertificate(ca CA, name string, request *CARequest, params *CAParams) (*CARequest, error) {
+	deadline := time.Now().Add(params.PendingTimeout.Duration)
+	for request.Status == CAStatusPending {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return request, nil
+		}
+		if wait > params.PendingInterval.Duration {
+			wait = params.PendingInterval.Duration
+		}
+
+		slog.Debug(fmt.Sprintf("Request[%s] is pending, next check in %s", request.Id, wait))
+		time.Sleep(wait)
+
+		var status CAStatus
+		attempts, err := withRetry(&params.Retry, name, func() error {
+			var err error
+			status, err = ca.Status(request.Id)
+			return err
+		})
+		request.Attempts += attempts - 1
+		request.Status = status
+		if err != nil {
+			return request, err
+		}
+	}
+
+	if request.Status != CAStatusIssued {
+		return request, fmt.Errorf("request[%s] status: %s", request.Id, request.Status)
+	}
+
+	if request.Certificate == "" {
+		var certificate string
+		attempts, err := withRetry(&params.Retry, name, func() error {
+			var err error
+			certificate, err = ca.Certificate(request.Id)
+			return err
+		})
+		request.Attempts += attempts - 1
+		if err != nil {
+			return request, err
+		}
+		request.Certificate = certificate
+	}
+	return request, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeCA is an in-process CA backend, Submit answers with the next of submits,
+// Status with the next of statuses and Certificate with certificate.
+type fakeCA struct {
+	submits     []fakeSubmit
+	statuses    []CAStatus
+	certificate string
+
+	submitted  []string
+	attributes []string
+}
+
+type fakeSubmit struct {
+	request *CARequest
+	err     error
+}
+
+func (ca *fakeCA) Submit(csr string) (*CARequest, error) {
+	ca.submitted = append(ca.submitted, csr)
+	next := ca.submits[0]
+	if len(ca.submits) > 1 {
+		ca.submits = ca.submits[1:]
+	}
+	if next.err != nil {
+		return nil, next.err
+	}
+	request := *next.request
+	return &request, nil
+}
+
+func (ca *fakeCA) Status(requestId string) (CAStatus, error) {
+	if len(ca.statuses) == 0 {
+		return CAStatusUnknown, ErrRequestIdNotFound
+	}
+	status := ca.statuses[0]
+	ca.statuses = ca.statuses[1:]
+	return status, nil
+}
+
+func (ca *fakeCA) Certificate(requestId string) (string, error) {
+	if ca.certificate == "" {
+		return "", ErrCertificateMissing
+	}
+	return ca.certificate, nil
+}
+
+func (ca *fakeCA) Root() (string, error)  { return "", ErrNotSupported }
+func (ca *fakeCA) Chain() (string, error) { return "", ErrNotSupported }
+
+// fakeAttributeCA also accepts request attributes.
+type fakeAttributeCA struct {
+	fakeCA
+}
+
+func (ca *fakeAttributeCA) SubmitWithAttributes(csr string, attributes []string) (*CARequest, error) {
+	ca.attributes = attributes
+	return ca.Submit(csr)
+}
+
+// fakeSessionCA keeps pending requests only during the run, as SCEP does.
+type fakeSessionCA struct {
+	fakeCA
+}
+
+func (ca *fakeSessionCA) SessionPending() {}
+
+func testCAParams(attempts int, pendingTimeout time.Duration) *CAParams {
+	return &CAParams{
+		PendingTimeout:  &Duration{pendingTimeout},
+		PendingInterval: &Duration{time.Millisecond},
+		Retry: RetryParams{
+			Attempts: &attempts,
+			Backoff:  &Duration{time.Millisecond},
+		},
+	}
+}
+
+func TestRequestCertificate(t *testing.T) {
+	issued := &CARequest{Id: "1", Status: CAStatusIssued, Certificate: "certificate"}
+	pending := &CARequest{Id: "2", Status: CAStatusPending}
+
+	tests := []struct {
+		name           string
+		ca             CA
+		pendingTimeout time.Duration
+		attributes     []string
+		status         CAStatus
+		certificate    string
+		attempts       int
+		submits        int
+		fails          bool
+	}{
+		{
+			name:        "issued right away",
+			ca:          &fakeCA{submits: []fakeSubmit{{request: issued}}},
+			status:      CAStatusIssued,
+			certificate: "certificate",
+			attempts:    1,
+			submits:     1,
+		},
+		{
+			name:           "pending then issued",
+			ca:             &fakeCA{submits: []fakeSubmit{{request: pending}}, statuses: []CAStatus{CAStatusPending, CAStatusIssued}, certificate: "polled"},
+			pendingTimeout: time.Second,
+			status:         CAStatusIssued,
+			certificate:    "polled",
+			attempts:       1,
+			submits:        1,
+		},
+		{
+			name:     "pending without timeout is kept",
+			ca:       &fakeCA{submits: []fakeSubmit{{request: pending}}},
+			status:   CAStatusPending,
+			attempts: 1,
+			submits:  1,
+		},
+		{
+			name:           "pending then denied",
+			ca:             &fakeCA{submits: []fakeSubmit{{request: pending}}, statuses: []CAStatus{CAStatusDenied}},
+			pendingTimeout: time.Second,
+			status:         CAStatusDenied,
+			attempts:       1,
+			submits:        1,
+			fails:          true,
+		},
+		{
+			name:     "session pending fails at the end of the run",
+			ca:       &fakeSessionCA{fakeCA{submits: []fakeSubmit{{request: pending}}}},
+			status:   CAStatusPending,
+			attempts: 1,
+			submits:  1,
+			fails:    true,
+		},
+		{
+			name:        "submit retried after 503",
+			ca:          &fakeCA{submits: []fakeSubmit{{err: &HTTPStatusError{StatusCode: 503}}, {request: issued}}},
+			status:      CAStatusIssued,
+			certificate: "certificate",
+			attempts:    2,
+			submits:     2,
+		},
+		{
+			name:     "submit not retried after 500",
+			ca:       &fakeCA{submits: []fakeSubmit{{err: &HTTPStatusError{StatusCode: 500}}, {request: issued}}},
+			status:   CAStatusUnknown,
+			attempts: 1,
+			submits:  1,
+			fails:    true,
+		},
+		{
+			name:     "denied by the CA",
+			ca:       &fakeCA{submits: []fakeSubmit{{err: &CAError{RequestId: "3", Status: CAStatusDenied}}}},
+			status:   CAStatusUnknown,
+			attempts: 1,
+			submits:  1,
+			fails:    true,
+		},
+		{
+			name:        "attributes are sent",
+			ca:          &fakeAttributeCA{fakeCA{submits: []fakeSubmit{{request: issued}}}},
+			attributes:  []string{"CertificateTemplate:User"},
+			status:      CAStatusIssued,
+			certificate: "certificate",
+			attempts:    1,
+			submits:     1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := requestCertificate(test.ca, "test", "csr", test.attributes, testCAParams(3, test.pendingTimeout))
+			if (err != nil) != test.fails {
+				t.Fatalf("requestCertificate() error = %v, expected error: %t", err, test.fails)
+			}
+			if request.Status != test.status {
+				t.Errorf("status = %s, expected %s", request.Status, test.status)
+			}
+			if request.Certificate != test.certificate {
+				t.Errorf("certificate = %q, expected %q", request.Certificate, test.certificate)
+			}
+			if request.Attempts != test.attempts {
+				t.Errorf("attempts = %d, expected %d", request.Attempts, test.attempts)
+			}
+
+			var fake *fakeCA
+			switch ca := test.ca.(type) {
+			case *fakeCA:
+				fake = ca
+			case *fakeAttributeCA:
+				fake = &ca.fakeCA
+			case *fakeSessionCA:
+				fake = &ca.fakeCA
+			}
+			if len(fake.submitted) != test.submits {
+				t.Errorf("submits = %d, expected %d", len(fake.submitted), test.submits)
+			}
+			if fmt.Sprint(fake.attributes) != fmt.Sprint(test.attributes) {
+				t.Errorf("attributes = %v, expected %v", fake.attributes, test.attributes)
+			}
+		})
+	}
+}
+
+func TestRenewCA(t *testing.T) {
+	ca := renewCA(&fakeCA{submits: []fakeSubmit{{request: &CARequest{Id: "1", Status: CAStatusIssued}}}})
+	if _, ok := ca.(*reenrollCA); ok {
+		t.Fatal("renewCA() wrapped a backend without Reenroller")
+	}
+
+	est, err := NewESTCA(&CAParams{Url: new(string)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := renewCA(est).(*reenrollCA); !ok {
+		t.Fatal("renewCA() did not use Reenroll of the EST backend")
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
 
 	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
@@ -15,58 +15,6 @@ import (
 
 const CAPICOM_STORE_OPEN_READ_WRITE = 1
 
-// func requestChain(params *Params) string {
-// 	client := http.Client{}
-// 	uri := fmt.Sprintf("https://%s/certsrv/certnew.p7b?ReqID=CACert&Renewal=-1&Enc=b64", *params.CA.Url)
-
-// 	resp, err := client.Get(uri)
-// 	if err != nil {
-// 		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", uri, err.Error()))
-// 		return ""
-// 	}
-// 	defer resp.Body.Close()
-
-// 	if resp.StatusCode != 200 {
-// 		slog.Debug(fmt.Sprintf("The chain could not be requested, status_code: %d", resp.StatusCode))
-// 		return ""
-// 	}
-
-// 	cert, err := io.ReadAll(resp.Body)
-// 	if err != nil {
-// 		slog.Debug(fmt.Sprintf("Cant read response, error: %s", err.Error()))
-// 		return ""
-// 	}
-
-// 	data := string(cert)
-// 	return data
-// }
-
-func requestRootCertificate(params *Params) string {
-	client := http.Client{}
-	uri := fmt.Sprintf("https://%s/certsrv/certnew.cer?ReqID=CACert&Renewal=-1&Enc=b64", *params.CA.Url)
-
-	resp, err := client.Get(uri)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", uri, err.Error()))
-		return ""
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		slog.Debug(fmt.Sprintf("The root certificate could not be requested, status_code: %d", resp.StatusCode))
-		return ""
-	}
-
-	cert, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Cant read response, error: %s", err.Error()))
-		return ""
-	}
-
-	certData := string(cert)
-	return certData
-}
-
 func getThumbprintFromBS64Certificate(data string) (string, error) {
 	rootCertificateDer := strings.ReplaceAll(data, "-----BEGIN CERTIFICATE-----\r\n", "")
 	rootCertificateDer = strings.ReplaceAll(rootCertificateDer, "-----END CERTIFICATE-----\r\n", "")
@@ -86,12 +34,45 @@ func getThumbprintFromBS64Certificate(data string) (string, error) {
 	return thumbprint, nil
 }
 
-// func installChainCertificate(chainFile string) error {
-// 	cm := cades.CadesManager{}
-// 	return cm.InstallCertificate(chainFile, "", true)
-// }
+// derToPem encodes a DER certificate the same way certsrv does: PEM with CRLF line endings.
+func derToPem(der []byte) string {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return strings.ReplaceAll(string(data), "\n", "\r\n")
+}
+
+// removePemArmor strips PEM header/footer lines and whitespace, leaving the base64 body.
+func removePemArmor(data []byte) []byte {
+	var body []byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, []byte("-----")) {
+			continue
+		}
+		body = append(body, line...)
+	}
+	return body
+}
+
+// pemToDer decodes PEM or bare base64 data.
+func pemToDer(data []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(string(removePemArmor(data)))
+}
+
+// parseCertificate parses a certificate in PEM, base64 or DER form.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	der, err := pemToDer(data)
+	if err != nil {
+		der = data
+	}
+	return x509.ParseCertificate(der)
+}
 
 func installRootCertificate(cadesObj *cades.Cades, certificateData string) error {
+	return installStoreCertificate(cadesObj, certificateData, "ROOT")
+}
+
+// installStoreCertificate adds the certificate to the current user store: ROOT, CA or My.
+func installStoreCertificate(cadesObj *cades.Cades, certificateData string, storeName string) error {
 	certificate, err := cades.NewCertificate(cadesObj)
 	if err != nil {
 		return err
@@ -105,7 +86,7 @@ func installRootCertificate(cadesObj *cades.Cades, certificateData string) error
 	}
 	defer store.Close()
 
-	err = store.Open(cades.CAPICOM_CURRENT_USER_STORE, "ROOT", CAPICOM_STORE_OPEN_READ_WRITE)
+	err = store.Open(cades.CAPICOM_CURRENT_USER_STORE, storeName, CAPICOM_STORE_OPEN_READ_WRITE)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/text/encoding/charmap"
+)
+
+var (
+	CERT_REQUEST_ID_PATTERN      = regexp.MustCompile(`(?m)ReqID=(\d+)&`)
+	CERT_PENDING_REQUEST_PATTERN = regexp.MustCompile(`(?mi)(?:Request Id is|идентификатор запроса)\D{0,16}(\d+)`)
+	CERTSRV_DISPOSITION_PATTERN  = regexp.MustCompile(`(?i)(?:disposition message is|сообщение о (?:состоянии|результате|обработке)[^"«]{0,16})\s*["«]([^"»]*)["»]`)
+	CERTSRV_HRESULT_PATTERN      = regexp.MustCompile(`0[xX][89][0-9A-Fa-f]{7}`)
+	CERTSRV_DENIED_PATTERN       = regexp.MustCompile(`(?i)request was denied|denied by|отклонен`)
+	CERTSRV_PENDING_PATTERN      = regexp.MustCompile(`(?i)taken under submission|must wait for an administrator|дождаться|находится на рассмотрении|принят на рассмотрение`)
+	CERTSRV_ERROR_PATTERN        = regexp.MustCompile(`(?i)(?:an unexpected error has occurred|непредвиденная ошибка|произошла ошибка)[^.]{0,200}`)
+	HTML_TAG_PATTERN             = regexp.MustCompile(`(?is)<(?:script|style)[^>]*>.*?</(?:script|style)>|<[^>]*>`)
+)
+
+// CERTSRV_HRESULT_NAMES maps the common certsrv HRESULT codes to their names for the log.
+var CERTSRV_HRESULT_NAMES = map[string]string{
+	"0x80070057": "E_INVALIDARG",
+	"0x80094001": "CERTSRV_E_BAD_REQUESTSUBJECT",
+	"0x80094004": "CERTSRV_E_PROPERTY_EMPTY",
+	"0x80094011": "CERTSRV_E_ENROLL_DENIED",
+	"0x80094012": "CERTSRV_E_TEMPLATE_DENIED",
+	"0x80094800": "CERTSRV_E_UNSUPPORTED_CERT_TYPE",
+	"0x80094801": "CERTSRV_E_NO_CERT_TYPE",
+	"0x80094802": "CERTSRV_E_TEMPLATE_CONFLICT",
+	"0x80094803": "CERTSRV_E_SUBJECT_ALT_NAME_REQUIRED",
+	"0x80094806": "CERTSRV_E_BAD_RENEWAL_SUBJECT",
+	"0x8009480D": "CERTSRV_E_SUBJECT_UPN_REQUIRED",
+	"0x8009480F": "CERTSRV_E_SUBJECT_DNS_REQUIRED",
+	"0x80094811": "CERTSRV_E_KEY_LENGTH",
+	"0x80094812": "CERTSRV_E_SUBJECT_EMAIL_REQUIRED",
+}
+
+// CertsrvCA talks to Microsoft/CryptoPro certsrv ASP pages.
+type CertsrvCA struct {
+	url    string
+	client *http.Client
+}
+
+func NewCertsrvCA(params *CAParams) (*CertsrvCA, error) {
+	client, err := newHTTPClient(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertsrvCA{
+		url:    caBaseURL(params),
+		client: client,
+	}, nil
+}
+
+func (ca *CertsrvCA) endpoint(path string) string {
+	return fmt.Sprintf("%s/certsrv/%s", ca.url, path)
+}
+
+func (ca *CertsrvCA) get(uri string) (string, error) {
+	resp, err := ca.client.Get(uri)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", uri, err.Error()))
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", &HTTPStatusError{Url: uri, StatusCode: resp.StatusCode}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Cant read response, error: %s", err.Error()))
+		return "", err
+	}
+
+	return decodeCertsrvPage(body), nil
+}
+
+func (ca *CertsrvCA) Submit(csr string) (*CARequest, error) {
+	return ca.SubmitWithAttributes(csr, nil)
+}
+
+// SubmitWithAttributes sends attributes in the CertAttrib form field, one "Name:Value" per line.
+func (ca *CertsrvCA) SubmitWithAttributes(csr string, attributes []string) (*CARequest, error) {
+	formData := url.Values{}
+	formData.Add("Mode", "newreq")
+	formData.Add("ThumbPrint", "")
+	formData.Add("TargetStoreFlags", "0")
+	formData.Add("SaveCert", "yes")
+	formData.Add("CertRequest", csr)
+	formData.Add("CertAttrib", strings.Join(attributes, "\r\n"))
+
+	encodeData := formData.Encode()
+	uri := ca.endpoint("certfnsh.asp")
+	request, err := http.NewRequest(
+		"POST", uri, strings.NewReader(encodeData),
+	)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ca.client.Do(request)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", uri, err.Error()))
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, &HTTPStatusError{Url: uri, StatusCode: resp.StatusCode}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Cant read response, error: %s", err.Error()))
+		return nil, err
+	}
+
+	data := decodeCertsrvPage(body)
+	match := CERT_REQUEST_ID_PATTERN.FindStringSubmatch(data)
+	if match != nil {
+		return &CARequest{Id: match[1], Status: CAStatusIssued}, nil
+	}
+
+	disposition := parseCertsrvPage(data)
+	if disposition.Status == CAStatusPending && disposition.RequestId != "" {
+		return &CARequest{Id: disposition.RequestId, Status: CAStatusPending}, nil
+	}
+	if disposition.Status == CAStatusPending {
+		// Without the id the request can be neither polled nor resumed, the caller deletes the container
+		disposition.Status = CAStatusUnknown
+		disposition.Disposition = strings.TrimSpace("pending without request id " + disposition.Disposition)
+	}
+
+	slog.Debug(fmt.Sprintf("Certificate not issued, response: %s", pageText(data)))
+	return nil, disposition
+}
+
+func (ca *CertsrvCA) Status(requestId string) (CAStatus, error) {
+	_, err := ca.Certificate(requestId)
+	var caErr *CAError
+	if err == ErrCertificateMissing {
+		return CAStatusPending, nil
+	} else if errors.As(err, &caErr) {
+		return caErr.Status, err
+	} else if err != nil {
+		return CAStatusUnknown, err
+	}
+	return CAStatusIssued, nil
+}
+
+func (ca *CertsrvCA) Certificate(requestId string) (string, error) {
+	uri := ca.endpoint(fmt.Sprintf("certnew.cer?ReqID=%s&Enc=b64", requestId))
+	data, err := ca.get(uri)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.Contains(data, "-----BEGIN CERTIFICATE-----") {
+		disposition := parseCertsrvPage(data)
+		if disposition.Status == CAStatusDenied || disposition.HResult != "" {
+			disposition.RequestId = requestId
+			return "", disposition
+		}
+		return "", ErrCertificateMissing
+	}
+	return data, nil
+}
+
+func (ca *CertsrvCA) Root() (string, error) {
+	return ca.get(ca.endpoint("certnew.cer?ReqID=CACert&Renewal=-1&Enc=b64"))
+}
+
+// CRL downloads the base or delta CRL published by certsrv.
+func (ca *CertsrvCA) CRL(delta bool) ([]byte, error) {
+	crlType := "base"
+	if delta {
+		crlType = "delta"
+	}
+
+	uri := ca.endpoint(fmt.Sprintf("certcrl.crl?Type=%s", crlType))
+	resp, err := ca.client.Get(uri)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", uri, err.Error()))
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, &HTTPStatusError{Url: uri, StatusCode: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (ca *CertsrvCA) Chain() (string, error) {
+	return ca.get(ca.endpoint("certnew.p7b?ReqID=CACert&Renewal=-1&Enc=b64"))
+}
+
+// decodeCertsrvPage converts the response to utf-8, localized CryptoPro CAs answer in windows-1251.
+func decodeCertsrvPage(body []byte) string {
+	if utf8.Valid(body) {
+		return string(body)
+	}
+
+	decoded, err := charmap.Windows1251.NewDecoder().Bytes(body)
+	if err != nil {
+		return string(body)
+	}
+	return string(decoded)
+}
+
+// parseCertsrvPage extracts the request id, disposition message and HRESULT from a certsrv page
+// without a certificate. Status is denied or pending when the page says so, unknown otherwise.
+func parseCertsrvPage(page string) *CAError {
+	result := &CAError{Status: CAStatusUnknown}
+	text := pageText(page)
+
+	if match := CERT_PENDING_REQUEST_PATTERN.FindStringSubmatch(text); match != nil {
+		result.RequestId = match[1]
+	}
+	if match := CERTSRV_DISPOSITION_PATTERN.FindStringSubmatch(text); match != nil {
+		result.Disposition = strings.TrimSpace(match[1])
+	}
+	if match := CERTSRV_HRESULT_PATTERN.FindString(text); match != "" {
+		result.HResult = "0x" + strings.ToUpper(match[2:])
+	}
+
+	switch {
+	case CERTSRV_DENIED_PATTERN.MatchString(text):
+		result.Status = CAStatusDenied
+	case CERTSRV_PENDING_PATTERN.MatchString(text):
+		result.Status = CAStatusPending
+	case result.RequestId != "" && result.HResult == "":
+		result.Status = CAStatusPending
+	}
+
+	if result.Disposition == "" {
+		result.Disposition = CERTSRV_ERROR_PATTERN.FindString(text)
+	}
+	return result
+}
+
+// pageText strips tags and collapses whitespace of a html page.
+func pageText(page string) string {
+	text := HTML_TAG_PATTERN.ReplaceAllString(page, " ")
+	text = html.UnescapeString(text)
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func cp1251(t *testing.T, text string) []byte {
+	t.Helper()
+	data, err := charmap.Windows1251.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseCertsrvPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     []byte
+		expected CAError
+	}{
+		{
+			name: "english denied",
+			page: []byte(`<HTML><Body><P ID=locDenied>Your certificate request was denied.</P>
+<P>Your Request Id is 42. The disposition message is "Denied by Policy Module  0x80094012,
+The permissions on the certificate template do not allow the current user to enroll for this type of certificate."</P></Body></HTML>`),
+			expected: CAError{
+				RequestId:   "42",
+				Status:      CAStatusDenied,
+				Disposition: "Denied by Policy Module 0x80094012, The permissions on the certificate template do not allow the current user to enroll for this type of certificate.",
+				HResult:     "0x80094012",
+			},
+		},
+		{
+			name: "english pending",
+			page: []byte(`<HTML><Body><P ID=locPageTitle>Certificate Pending</P>
+<P>Your certificate request has been received. However, you must wait for an administrator to issue the certificate you requested.</P>
+<P>Your Request Id is 17.</P></Body></HTML>`),
+			expected: CAError{RequestId: "17", Status: CAStatusPending},
+		},
+		{
+			name: "english error",
+			page: []byte(`<HTML><Body><P ID=locPageTitle>Certificate Request Error</P>
+<P>An unexpected error has occurred: The disposition message is "Error Parsing Request The signature of the request is invalid. 0x80090006 (-2146893818 NTE_BAD_SIGNATURE)"</P></Body></HTML>`),
+			expected: CAError{
+				Status:      CAStatusUnknown,
+				Disposition: "Error Parsing Request The signature of the request is invalid. 0x80090006 (-2146893818 NTE_BAD_SIGNATURE)",
+				HResult:     "0x80090006",
+			},
+		},
+		{
+			name: "russian cp1251 pending",
+			page: cp1251(t, `<HTML><Body><P>Запрос сертификата получен. Однако необходимо дождаться, пока администратор выдаст запрошенный сертификат.</P>
+<P>Ваш идентификатор запроса: 23.</P></Body></HTML>`),
+			expected: CAError{RequestId: "23", Status: CAStatusPending},
+		},
+		{
+			name: "russian cp1251 denied",
+			page: cp1251(t, `<HTML><Body><P>Запрос сертификата отклонен.</P>
+<P>Ваш идентификатор запроса: 24. Сообщение о состоянии: «Отклонено модулем политики 0x80094012»</P></Body></HTML>`),
+			expected: CAError{
+				RequestId:   "24",
+				Status:      CAStatusDenied,
+				Disposition: "Отклонено модулем политики 0x80094012",
+				HResult:     "0x80094012",
+			},
+		},
+		{
+			name:     "empty page",
+			page:     []byte(`<HTML><Body></Body></HTML>`),
+			expected: CAError{Status: CAStatusUnknown},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := parseCertsrvPage(decodeCertsrvPage(test.page))
+			if *result != test.expected {
+				t.Errorf("parseCertsrvPage() = %+v, expected %+v", *result, test.expected)
+			}
+		})
+	}
+}
+
+func TestDecodeCertsrvPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		expected string
+	}{
+		{name: "utf-8", body: []byte("Запрос отклонен"), expected: "Запрос отклонен"},
+		{name: "cp1251", body: cp1251(t, "Запрос отклонен"), expected: "Запрос отклонен"},
+		{name: "ascii", body: []byte("Request denied"), expected: "Request denied"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := decodeCertsrvPage(test.body); result != test.expected {
+				t.Errorf("decodeCertsrvPage() = %q, expected %q", result, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+const (
+	ProxyDirect = "direct"
+
+	AuthTypeBasic = "basic"
+	AuthTypeNTLM  = "ntlm"
+	AuthTypeCert  = "cert"
+)
+
+var ErrAuthUsernameMissing = errors.New("auth username is not set")
+
+// newHTTPClient builds the http client shared by all requests to the CA.
+func newHTTPClient(params *CAParams) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if params.Auth.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(params.Auth.ClientCert, params.Auth.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	} else if params.Auth.Type == AuthTypeCert {
+		return nil, errors.New("auth clientCert is not set")
+	}
+
+	if params.CABundle != "" {
+		rootCAs, err := loadCABundle(params.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	tlsConfig.InsecureSkipVerify = params.InsecureSkipVerify
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	switch params.Proxy {
+	case "":
+	case ProxyDirect:
+		transport.Proxy = nil
+	default:
+		proxyUrl, err := url.Parse(params.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	if params.ConnectTimeout != nil && params.ConnectTimeout.Duration > 0 {
+		dialer := &net.Dialer{
+			Timeout:   params.ConnectTimeout.Duration,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = params.ConnectTimeout.Duration
+	}
+
+	var roundTripper http.RoundTripper = transport
+
+	authType := params.Auth.Type
+	username, password, err := params.Auth.credentials()
+	if err != nil {
+		return nil, err
+	}
+	if authType == "" && username != "" {
+		authType = AuthTypeBasic
+	}
+
+	switch authType {
+	case "", AuthTypeCert:
+	case AuthTypeBasic, AuthTypeNTLM:
+		if username == "" {
+			return nil, ErrAuthUsernameMissing
+		}
+		if authType == AuthTypeNTLM {
+			// Negotiator converts basic credentials to NTLM handshake when the server asks for it
+			roundTripper = ntlmssp.Negotiator{RoundTripper: roundTripper}
+		}
+		roundTripper = &basicAuthTransport{
+			username:  username,
+			password:  password,
+			transport: roundTripper,
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth type: %s", authType)
+	}
+
+	if params.RateLimit != nil && *params.RateLimit > 0 {
+		roundTripper = newRateLimitTransport(*params.RateLimit, roundTripper)
+	}
+
+	client := &http.Client{Transport: roundTripper}
+	if params.Timeout != nil {
+		client.Timeout = params.Timeout.Duration
+	}
+	return client, nil
+}
+
+// newPublicHTTPClient builds a client for urls taken from certificates (CDP, freshest CRL),
+// it keeps trust, proxy and timeouts of the CA client but never sends the CA credentials.
+func newPublicHTTPClient(params *CAParams) (*http.Client, error) {
+	public := *params
+	public.Auth = AuthParams{}
+	return newHTTPClient(&public)
+}
+
+// sameOrigin reports whether uri has the scheme and host of the CA url.
+func sameOrigin(uri string, params *CAParams) bool {
+	target, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	base, err := url.Parse(caBaseURL(params))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(target.Scheme, base.Scheme) && strings.EqualFold(target.Host, base.Host)
+}
+
+// caBaseURL returns the CA url with scheme and without trailing slash,
+// a bare host name is treated as https for older configs.
+func caBaseURL(params *CAParams) string {
+	uri := strings.TrimRight(*params.Url, "/")
+	if !strings.Contains(uri, "://") {
+		uri = "https://" + uri
+	}
+	return uri
+}
+
+// loadCABundle reads PEM or DER certificates trusted in addition to the system roots.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if pool.AppendCertsFromPEM(data) {
+		return pool, nil
+	}
+
+	certificates, err := x509.ParseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("no certificates found in %s, error: %s", path, err.Error())
+	}
+	for _, certificate := range certificates {
+		pool.AddCert(certificate)
+	}
+	return pool, nil
+}
+
+// credentials reads username and password from env variables or files,
+// so secrets are never stored in the config itself.
+func (auth *AuthParams) credentials() (string, string, error) {
+	username := auth.Username
+	if auth.UsernameEnv != "" {
+		username = os.Getenv(auth.UsernameEnv)
+	}
+
+	var password string
+	if auth.PasswordEnv != "" {
+		password = os.Getenv(auth.PasswordEnv)
+	} else if auth.PasswordFile != "" {
+		data, err := os.ReadFile(auth.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	return username, password, nil
+}
+
+type basicAuthTransport struct {
+	username  string
+	password  string
+	transport http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.SetBasicAuth(t.username, t.password)
+	return t.transport.RoundTrip(request)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigFormatJSON = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+var (
+	YAML_ERROR_LINE_PATTERN    = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+	TOML_ERROR_LINE_PATTERN    = regexp.MustCompile(`^toml: line \d+(?: \(last key "[^"]*"\))?: `)
+	JSON_UNKNOWN_FIELD_PATTERN = regexp.MustCompile(`^json: unknown field "([^"]*)"$`)
+)
+
+// configFormat returns the format set by -format or guessed from the file extension, json by default.
+func configFormat(path string) (string, error) {
+	format := strings.ToLower(*formatFlag)
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	switch format {
+	case "yaml", "yml":
+		return ConfigFormatYAML, nil
+	case "toml":
+		return ConfigFormatTOML, nil
+	case "json", "jsonc", "json5", "":
+		return ConfigFormatJSON, nil
+	}
+
+	if *formatFlag != "" {
+		return "", fmt.Errorf("unknown config format: %s", *formatFlag)
+	}
+	return ConfigFormatJSON, nil
+}
+
+// configToJSON converts a yaml or toml config into json, so all formats are decoded by initConfig
+// with the same json tags and Duration parsing.
+func configToJSON(file string, format string, data []byte) ([]byte, error) {
+	var value any
+
+	switch format {
+	case ConfigFormatYAML:
+		err := yaml.Unmarshal(data, &value)
+		if err != nil {
+			return nil, newYAMLConfigError(file, err)
+		}
+	case ConfigFormatTOML:
+		var table map[string]any
+		err := toml.Unmarshal(data, &table)
+		if err != nil {
+			var parseErr toml.ParseError
+			if errors.As(err, &parseErr) {
+				line, column := offsetPosition(data, int64(parseErr.Position.Start+1))
+				message := TOML_ERROR_LINE_PATTERN.ReplaceAllString(parseErr.Error(), "")
+				return nil, &ConfigError{File: file, Line: line, Column: column, Message: message}
+			}
+			return nil, &ConfigError{File: file, Message: err.Error()}
+		}
+		value = table
+	default:
+		return data, nil
+	}
+
+	if value == nil {
+		value = map[string]any{}
+	}
+	return json.Marshal(jsonValue(value))
+}
+
+// jsonValue replaces yaml maps with non-string keys, e.g. numeric OIDs in dn, by maps with string keys.
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonValue(item)
+		}
+		return v
+	case map[any]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return result
+	case []any:
+		for index, item := range v {
+			v[index] = jsonValue(item)
+		}
+		return v
+	}
+	return value
+}
+
+func newYAMLConfigError(file string, err error) *ConfigError {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		err = errors.New(typeErr.Errors[0])
+	}
+
+	match := YAML_ERROR_LINE_PATTERN.FindStringSubmatch(err.Error())
+	if match == nil {
+		return &ConfigError{File: file, Message: err.Error()}
+	}
+	line, _ := strconv.Atoi(match[1])
+	return &ConfigError{File: file, Line: line, Message: match[2]}
+}
+
+// keyPosition finds the first definition of key in a config file, the decoder does not report positions
+// of unknown fields and of fields converted from yaml and toml.
+func keyPosition(data []byte, format string, key string) (int, int) {
+	quoted := regexp.QuoteMeta(key)
+	var pattern string
+	switch format {
+	case ConfigFormatYAML:
+		pattern = fmt.Sprintf(`(?m)^[\t -]*["']?(%s)["']?\s*:`, quoted)
+	case ConfigFormatTOML:
+		pattern = fmt.Sprintf(`(?m)(?:^|[{,.\[]\s*)["']?(%s)["']?\s*[=\].]`, quoted)
+	default:
+		pattern = fmt.Sprintf(`"(%s)"\s*:`, quoted)
+	}
+
+	match := regexp.MustCompile(pattern).FindSubmatchIndex(data)
+	if match == nil {
+		return 0, 0
+	}
+	return offsetPosition(data, int64(match[2]+1))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	TEST_CONFIG_JSON = `{
+	// comments and trailing commas are allowed
+	"params": {
+		"batchSize": 10,
+		"batchInterval": "1m30s",
+		"ca": {"type": "certsrv", "url": "http://ca.lan", "pendingTimeout": "5m", "retry": {"attempts": 3}},
+	},
+	"requests": [
+		{
+			"count": 2,
+			"extensionEKU": ["1.3.6.1.5.5.7.3.2", "1.3.6.1.5.5.7.3.4"],
+			"certAttributes": {"CertificateTemplate": "User"},
+			"container": {"name": "TEST_{{.Number}}", "exportable": true, "keySpec": 1},
+			"san": {"2.5.29.17": ["user@ca.lan"]},
+			"dn": {"CN": "Test", "1.2.643.100.3": "00000000000"},
+		},
+	],
+}`
+	TEST_CONFIG_YAML = `# comments
+params:
+  batchSize: 10
+  batchInterval: 1m30s
+  ca:
+    type: certsrv
+    url: http://ca.lan
+    pendingTimeout: 5m
+    retry:
+      attempts: 3
+requests:
+  - count: 2
+    extensionEKU: [1.3.6.1.5.5.7.3.2, 1.3.6.1.5.5.7.3.4]
+    certAttributes:
+      CertificateTemplate: User
+    container:
+      name: "TEST_{{.Number}}"
+      exportable: true
+      keySpec: 1
+    san:
+      2.5.29.17: [user@ca.lan]
+    dn:
+      CN: Test
+      1.2.643.100.3: "00000000000"
+`
+	TEST_CONFIG_TOML = `# comments
+[params]
+batchSize = 10
+batchInterval = "1m30s"
+
+[params.ca]
+type = "certsrv"
+url = "http://ca.lan"
+pendingTimeout = "5m"
+retry = {attempts = 3}
+
+[[requests]]
+count = 2
+extensionEKU = ["1.3.6.1.5.5.7.3.2", "1.3.6.1.5.5.7.3.4"]
+certAttributes = {CertificateTemplate = "User"}
+container = {name = "TEST_{{.Number}}", exportable = true, keySpec = 1}
+san = {"2.5.29.17" = ["user@ca.lan"]}
+dn = {CN = "Test", "1.2.643.100.3" = "00000000000"}
+`
+)
+
+func writeTestConfig(t *testing.T, name string, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFormats(t *testing.T) {
+	expected, err := loadConfig(writeTestConfig(t, "config.json", TEST_CONFIG_JSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{name: "yaml", file: "config.yaml", data: TEST_CONFIG_YAML},
+		{name: "yml", file: "config.yml", data: TEST_CONFIG_YAML},
+		{name: "toml", file: "config.toml", data: TEST_CONFIG_TOML},
+		{name: "jsonc", file: "config.jsonc", data: TEST_CONFIG_JSON},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := loadConfig(writeTestConfig(t, test.file, test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("loadConfig(%s) = %+v, expected %+v", test.file, config, expected)
+			}
+		})
+	}
+}
+
+func TestConfigUnknownFields(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		line int
+	}{
+		{name: "json", file: "config.json", data: "{\n\"requests\": [],\n\"unknown\": 1\n}", line: 3},
+		{name: "yaml", file: "config.yaml", data: "requests: []\nparams:\n  unknown: 1\n", line: 3},
+		{name: "toml", file: "config.toml", data: "requests = []\n\n[params.ca]\nunknown = 1\n", line: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadConfig(writeTestConfig(t, test.file, test.data))
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("loadConfig() error = %v, expected ConfigError", err)
+			}
+			if configErr.Line != test.line || !strings.Contains(configErr.Message, "unknown") {
+				t.Errorf("loadConfig() error = %v, expected unknown field at line %d", err, test.line)
+			}
+		})
+	}
+}
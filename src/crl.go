@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	"golang.org/x/exp/slog"
+)
+
+const CRL_FOLDER = "crl"
+
+var (
+	oidExtensionDeltaCRLIndicator = asn1.ObjectIdentifier{2, 5, 29, 27}
+	oidExtensionFreshestCRL       = asn1.ObjectIdentifier{2, 5, 29, 46}
+)
+
+// CRLProvider is implemented by backends that publish CRLs next to the enrollment endpoint.
+type CRLProvider interface {
+	CRL(delta bool) ([]byte, error)
+}
+
+// CRLInfo describes a downloaded CRL for the run report.
+type CRLInfo struct {
+	Url        string    `json:"url"`
+	File       string    `json:"file"`
+	Issuer     string    `json:"issuer"`
+	Delta      bool      `json:"delta,omitempty"`
+	NextUpdate time.Time `json:"nextUpdate"`
+}
+
+type distributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+	Reason            asn1.BitString        `asn1:"optional,tag:1"`
+	CRLIssuer         asn1.RawValue         `asn1:"optional,tag:2"`
+}
+
+type distributionPointName struct {
+	FullName     []asn1.RawValue  `asn1:"optional,tag:0"`
+	RelativeName pkix.RDNSequence `asn1:"optional,tag:1"`
+}
+
+// crlDownloader keeps the downloaded urls, so CRLs shared by many certificates are fetched once.
+// Each CA gets a client with its credentials, used only for urls on the CA host, and a public client for all others.
+type crlDownloader struct {
+	folder     string
+	skipStore  bool
+	clients    map[string]*crlClients
+	downloaded map[string]bool
+	crls       []CRLInfo
+}
+
+type crlClients struct {
+	client   *http.Client
+	caClient *http.Client
+}
+
+// InstallCRLs downloads base and delta CRLs of the CAs used in the run and of the issued certificates,
+// saves them into {outputFolder}/crl and installs them into the CA store.
+func InstallCRLs(pool *caPool, containersInfo []ContainerInfo) []CRLInfo {
+	folder := filepath.Join(pool.global.OutputFolder, CRL_FOLDER)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		slog.Error(fmt.Sprintf("Cant create folder: %s, error: %s", folder, err.Error()))
+		return nil
+	}
+
+	downloader := &crlDownloader{
+		folder:     folder,
+		skipStore:  *pool.global.SkipStore,
+		clients:    map[string]*crlClients{},
+		downloaded: map[string]bool{},
+	}
+
+	for _, used := range pool.used {
+		provider, ok := used.ca.(CRLProvider)
+		if !ok {
+			continue
+		}
+
+		for _, delta := range []bool{false, true} {
+			name := fmt.Sprintf("ca crl (delta: %t)", delta)
+			var data []byte
+			_, err := withRetry(&used.params.CA.Retry, name, func() error {
+				var err error
+				data, err = provider.CRL(delta)
+				return err
+			})
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Cant download %s, error: %s", name, err.Error()))
+				continue
+			}
+
+			filename := "ca_base.crl"
+			if delta {
+				filename = "ca_delta.crl"
+			}
+			if used.params.CA.Name != "" {
+				filename = fmt.Sprintf("%s_%s", used.params.CA.Name, filename)
+			}
+			downloader.save(name, filename, data)
+		}
+	}
+
+	for index := range containersInfo {
+		info := &containersInfo[index]
+		if info.Thumbprint == "" {
+			continue
+		}
+
+		params, err := pool.Params(infoRequest(info))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Cant resolve params, container[%s], error: %s", info.Name, err.Error()))
+			continue
+		}
+
+		certificatePath := filepath.Join(infoOutputFolder(params, info), fmt.Sprintf("%s.cer", info.Name))
+		data, err := os.ReadFile(certificatePath)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Cant read certificate: %s, error: %s", certificatePath, err.Error()))
+			continue
+		}
+
+		certificate, err := parseCertificate(data)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Cant parse certificate: %s, error: %s", certificatePath, err.Error()))
+			continue
+		}
+
+		for _, uri := range certificate.CRLDistributionPoints {
+			downloader.download(uri, false, &params.CA)
+		}
+		for _, uri := range freshestCRLUrls(certificate.Extensions) {
+			downloader.download(uri, true, &params.CA)
+		}
+	}
+	return downloader.crls
+}
+
+// clientsFor returns the http clients of the CA, created once per CA name.
+func (d *crlDownloader) clientsFor(params *CAParams) (*crlClients, error) {
+	if clients, ok := d.clients[params.Name]; ok {
+		return clients, nil
+	}
+
+	caClient, err := newHTTPClient(params)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newPublicHTTPClient(params)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := &crlClients{client: client, caClient: caClient}
+	d.clients[params.Name] = clients
+	return clients, nil
+}
+
+// download fetches the CRL from uri, params is the CA of the certificate that points to it.
+func (d *crlDownloader) download(uri string, delta bool, params *CAParams) {
+	if d.downloaded[uri] {
+		return
+	}
+	d.downloaded[uri] = true
+
+	if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+		slog.Debug(fmt.Sprintf("Skip crl distribution point: %s", uri))
+		return
+	}
+
+	clients, err := d.clientsFor(params)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create http client, error: %s", err.Error()))
+		return
+	}
+
+	client := clients.client
+	if sameOrigin(uri, params) {
+		client = clients.caClient
+	}
+
+	var data []byte
+	_, err = withRetry(&params.Retry, uri, func() error {
+		resp, err := client.Get(uri)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			return &HTTPStatusError{Url: uri, StatusCode: resp.StatusCode}
+		}
+
+		data, err = io.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Cant download crl: %s, error: %s", uri, err.Error()))
+		return
+	}
+
+	crl := d.save(uri, crlFileName(uri), data)
+	if crl == nil || delta {
+		return
+	}
+
+	for _, deltaUri := range freshestCRLUrls(crl.Extensions) {
+		d.download(deltaUri, true, params)
+	}
+}
+
+// crlFileName returns the file name of a downloaded CRL. Distribution points often share the base name
+// (ca.crl on different hosts), so it is prefixed with a short hash of the whole url.
+func crlFileName(uri string) string {
+	filename := path.Base(strings.SplitN(uri, "?", 2)[0])
+	if !strings.HasSuffix(strings.ToLower(filename), ".crl") {
+		filename += ".crl"
+	}
+
+	hash := sha1.Sum([]byte(uri))
+	return fmt.Sprintf("%s_%s", hex.EncodeToString(hash[:4]), filename)
+}
+
+// save writes the CRL to disk, installs it and records it in the report.
+func (d *crlDownloader) save(source string, filename string, data []byte) *x509.RevocationList {
+	der, err := pemToDer(data)
+	if err != nil {
+		der = data
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Cant parse crl: %s, error: %s", source, err.Error()))
+		return nil
+	}
+
+	crlFilePath := filepath.Join(d.folder, filename)
+	err = os.WriteFile(crlFilePath, der, 0644)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", crlFilePath, err.Error()))
+		return nil
+	}
+
+	delta := false
+	for _, extension := range crl.Extensions {
+		if extension.Id.Equal(oidExtensionDeltaCRLIndicator) {
+			delta = true
+		}
+	}
+
+	d.crls = append(d.crls, CRLInfo{
+		Url:        source,
+		File:       filename,
+		Issuer:     crl.Issuer.String(),
+		Delta:      delta,
+		NextUpdate: crl.NextUpdate,
+	})
+
+	if d.skipStore {
+		return crl
+	}
+
+	absPath, _ := filepath.Abs(crlFilePath)
+	output, err := cades.NewCertManagerProcess("-inst", "-crl", "-store", "uCA", "-file", absPath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant install crl: %s, error: %s", filename, err.Error()))
+		slog.Debug(fmt.Sprintf("Certmgr log: %s", output))
+	} else {
+		slog.Info(fmt.Sprintf("Installed crl: %s", filename))
+	}
+	return crl
+}
+
+// freshestCRLUrls returns http urls of the delta CRLs from the Freshest CRL extension.
+func freshestCRLUrls(extensions []pkix.Extension) []string {
+	var urls []string
+	for _, extension := range extensions {
+		if !extension.Id.Equal(oidExtensionFreshestCRL) {
+			continue
+		}
+
+		var points []distributionPoint
+		if _, err := asn1.Unmarshal(extension.Value, &points); err != nil {
+			slog.Debug(fmt.Sprintf("Cant parse freshest crl extension, error: %s", err.Error()))
+			continue
+		}
+
+		for _, point := range points {
+			for _, name := range point.DistributionPoint.FullName {
+				// uniformResourceIdentifier [6] IA5String
+				if name.Tag == 6 {
+					urls = append(urls, string(name.Bytes))
+				}
+			}
+		}
+	}
+	return urls
+}
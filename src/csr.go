@@ -1,12 +1,12 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
 	"github.com/google/uuid"
@@ -15,48 +15,101 @@ import (
 
 const (
 	ContextUser                            = 0x1
+	XCN_CERT_ENCIPHER_ONLY_KEY_USAGE       = 0x01
+	XCN_CERT_CRL_SIGN_KEY_USAGE            = 0x02
+	XCN_CERT_KEY_CERT_SIGN_KEY_USAGE       = 0x04
+	XCN_CERT_KEY_AGREEMENT_KEY_USAGE       = 0x08
 	XCN_CERT_DATA_ENCIPHERMENT_KEY_USAGE   = 0x10
 	XCN_CERT_KEY_ENCIPHERMENT_KEY_USAGE    = 0x20
 	XCN_CERT_NON_REPUDIATION_KEY_USAGE     = 0x40
 	XCN_CERT_DIGITAL_SIGNATURE_KEY_USAGE   = 0x80
+	XCN_CERT_DECIPHER_ONLY_KEY_USAGE       = 0x8000
 	XCN_CRYPT_HASH_INTERFACE               = 0x2
 	XCN_CRYPT_STRING_BASE64                = 1
 	XCN_CERT_NAME_STR_ENABLE_PUNYCODE_FLAG = 2097152
 	XEKL_KEYSPEC_KEYX                      = 1
+	ALLOW_UNTRUSTED_CERTIFICATE            = 2
 	ALLOW_UNTRUSTED_ROOT                   = 4
 	XCN_CRYPT_STRING_BINARY                = 0x2
+	SELF_SIGNED_VALIDITY                   = 365 * 24 * time.Hour
 )
 
-var (
-	CERT_REQUEST_ID_PATTERN = regexp.MustCompile(`(?m)ReqID=\d*&`)
-)
-
+// Container fields are pointers where false or 0 must override a value inherited from a profile.
 type Container struct {
 	Name          string `json:"name,omitempty"`
-	Exportable    bool   `json:"exportable,omitempty"`
+	Exportable    *bool  `json:"exportable,omitempty"`
 	KeySpec       *int   `json:"keySpec,omitempty"`
-	KeyProtection int    `json:"keyProtection,omitempty"`
+	KeyProtection *int   `json:"keyProtection,omitempty"`
 	Pin           string `json:"pin,omitempty"`
 }
 
+func (c *Container) isExportable() bool {
+	return c.Exportable != nil && *c.Exportable
+}
+
+func (c *Container) keyProtection() int {
+	if c.KeyProtection == nil {
+		return 0
+	}
+	return *c.KeyProtection
+}
+
 type CsrParams struct {
-	ExtensionEKU     []string            `json:"extensionEKU,omitempty"`
-	EKUKeyUsageFlags *int                `json:"ekuKeyUsageFlags,omitempty"`
-	ProviderName     string              `json:"providerName,omitempty"`
-	Container        Container           `json:"container,omitempty"`
-	SAN              map[string][]string `json:"san,omitempty"`
-	Dn               map[string]string   `json:"dn"`
+	// Overrides of the global params for this request
+	CA             json.RawMessage `json:"ca,omitempty"`
+	Flat           *bool           `json:"flat,omitempty"`
+	SkipStore      *bool           `json:"skipStore,omitempty"`
+	SkipCSRRequest *bool           `json:"skipCSRRequest,omitempty"`
+	OutputFolder   string          `json:"outputFolder,omitempty"`
+
+	// Count is the number of copies of the request, see expandRequests
+	Count int `json:"count,omitempty"`
+	// Extends is the name of the profile the request is based on, see resolveRequests
+	Extends string `json:"extends,omitempty"`
+	// CsrFile is an existing PKCS#10 request, container, dn and key params are not used with it
+	CsrFile string `json:"csrFile,omitempty"`
+
+	SelfSigned        *bool               `json:"selfSigned,omitempty"`
+	ChallengePassword string              `json:"challengePassword,omitempty"`
+	Template          string              `json:"template,omitempty"`
+	CertAttributes    map[string]string   `json:"certAttributes,omitempty"`
+	ExtensionEKU      []string            `json:"extensionEKU,omitempty"`
+	EKUKeyUsageFlags  *int                `json:"ekuKeyUsageFlags,omitempty"`
+	ProviderName      string              `json:"providerName,omitempty"`
+	Container         Container           `json:"container,omitempty"`
+	SAN               map[string][]string `json:"san,omitempty"`
+	Dn                map[string]string   `json:"dn"`
 }
 
-func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, error) {
+// certAttributes returns the request attributes sent to the CA along with the csr,
+// CertificateTemplate goes first, the rest are sorted by name.
+func certAttributes(params *CsrParams) []string {
+	var attributes []string
+	if params.Template != "" {
+		attributes = append(attributes, fmt.Sprintf("CertificateTemplate:%s", params.Template))
+	}
+
+	names := make([]string, 0, len(params.CertAttributes))
+	for name := range params.CertAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		attributes = append(attributes, fmt.Sprintf("%s:%s", name, params.CertAttributes[name]))
+	}
+	return attributes
+}
+
+func createPrivateKey(x509 *cades.X509EnrollmentRoot, params *CsrParams) (*cades.CX509PrivateKey, error) {
 	informations, err := x509.CCspInformations()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	err = informations.AddAvailableCsps()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if params.ProviderName == "" {
@@ -65,33 +118,33 @@ func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, err
 
 	status, err := informations.GetCspStatusFromProviderName(params.ProviderName, XEKL_KEYSPEC_KEYX)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	algorithm, err := status.CspAlgorithm()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	defaultKeyLength, err := algorithm.DefaultLength()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	information, err := status.CspInformation()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	providerType, err := information.Type()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Private Key
 	pk, err := x509.CX509PrivateKey()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if params.Container.KeySpec == nil {
@@ -100,32 +153,32 @@ func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, err
 		_, err = pk.SetKeySpec(*params.Container.KeySpec)
 	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	_, err = pk.SetProviderName(params.ProviderName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	_, err = pk.SetProviderType(providerType)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	_, err = pk.SetKeyProtection(params.Container.KeyProtection)
+	_, err = pk.SetKeyProtection(params.Container.keyProtection())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	_, err = pk.SetLength(defaultKeyLength)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	_, err = pk.SetMachineContext(false)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if params.Container.Name == "" {
@@ -135,42 +188,38 @@ func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, err
 
 	_, err = pk.SetContainerName(params.Container.Name)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if params.Container.Exportable {
+	if params.Container.isExportable() {
 		_, err = pk.SetExportPolicy(1)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	} else {
 		_, err = pk.SetExportPolicy(0)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
 	if params.Container.Pin != "" {
 		_, err = pk.SetPin(params.Container.Pin)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
-	request, err := x509.CX509CertificateRequestPkcs10()
-	if err != nil {
-		return "", err
-	}
-
-	err = request.InitializeFromPrivateKey(1, *(*cades.CadesObject)(pk), "")
-	if err != nil {
-		return "", err
-	}
+	return pk, nil
+}
 
+// initializeRequest fills subject, key usage, EKU, SAN and hash algorithm of a pkcs10 or
+// self-signed certificate request, both objects share these properties.
+func initializeRequest(x509 *cades.X509EnrollmentRoot, request *cades.CX509CertificateRequestPkcs10, params *CsrParams, isCA bool) error {
 	// Extension Key Usage
 	eku, err := x509.CX509ExtensionKeyUsage()
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	if params.EKUKeyUsageFlags == nil {
@@ -184,95 +233,97 @@ func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, err
 
 	err = eku.InitializeEncode(*params.EKUKeyUsageFlags)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	ext, err := request.X509Extensions()
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	err = ext.Add((*cades.CX509Extension)(eku))
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	// Subject
 	subjectInfo := dnToX500DistinguishedName(params.Dn)
 	oDn, err := x509.CX500DistinguishedName()
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	err = oDn.Encode(subjectInfo, XCN_CERT_NAME_STR_ENABLE_PUNYCODE_FLAG)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	_, err = request.SetSubject(oDn)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	// Enhanced Key Usage
-	oids, err := x509.CObjectIds()
-	if err != nil {
-		return "", err
-	}
+	// Enhanced Key Usage, CA certificates are left without it so issued EKUs are not restricted
+	if !isCA {
+		oids, err := x509.CObjectIds()
+		if err != nil {
+			return err
+		}
 
-	if len(params.ExtensionEKU) <= 0 {
-		params.ExtensionEKU = []string{
-			"1.3.6.1.5.5.7.3.2",
+		if len(params.ExtensionEKU) <= 0 {
+			params.ExtensionEKU = []string{
+				"1.3.6.1.5.5.7.3.2",
+			}
 		}
-	}
 
-	for _, oid := range params.ExtensionEKU {
-		oidObject, err := x509.CObjectId()
-		if err != nil {
-			return "", err
+		for _, oid := range params.ExtensionEKU {
+			oidObject, err := x509.CObjectId()
+			if err != nil {
+				return err
+			}
+
+			err = oidObject.InitializeFromValue(oid)
+			if err != nil {
+				return err
+			}
+
+			err = oids.Add(oidObject)
+			if err != nil {
+				return err
+			}
 		}
 
-		err = oidObject.InitializeFromValue(oid)
+		eeku, err := x509.CX509ExtensionEnhancedKeyUsage()
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		err = oids.Add(oidObject)
+		err = eeku.InitializeEncode(oids)
 		if err != nil {
-			return "", err
+			return err
 		}
-	}
-
-	eeku, err := x509.CX509ExtensionEnhancedKeyUsage()
-	if err != nil {
-		return "", err
-	}
-
-	err = eeku.InitializeEncode(oids)
-	if err != nil {
-		return "", err
-	}
 
-	ext2, err := request.X509Extensions()
-	if err != nil {
-		return "", err
-	}
+		ext2, err := request.X509Extensions()
+		if err != nil {
+			return err
+		}
 
-	err = ext2.Add((*cades.CX509Extension)(eeku))
-	if err != nil {
-		return "", err
+		err = ext2.Add((*cades.CX509Extension)(eeku))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Subject alternative name
 	if len(params.SAN) != 0 {
 		cadesVersion, err := cades.GetCadesVersion(x509.Cades)
 		if err != nil {
-			return "", err
+			return err
 		}
 
 		pluginVersion, err := cades.GetPluginVersion(x509.Cades)
 		if err != nil {
-			return "", err
+			return err
 		}
 
 		// КриптоПро CSP 5.0 R4 (сборка 5.0.13300 Uroboros) или новей
@@ -281,56 +332,56 @@ func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, err
 			(pluginVersion.Build >= 2 && pluginVersion.Minor >= 0 && pluginVersion.Build >= 15260) {
 			altNames, err := x509.CAlternativeNames()
 			if err != nil {
-				return "", err
+				return err
 			}
 
 			for oid, values := range params.SAN {
 				for _, value := range values {
 					objId, err := x509.CObjectId()
 					if err != nil {
-						return "", err
+						return err
 					}
 
 					err = objId.InitializeFromValue(oid)
 					if err != nil {
-						return "", err
+						return err
 					}
 
 					altName, err := x509.CAlternativeName()
 					if err != nil {
-						return "", err
+						return err
 					}
 
 					err = altName.InitializeFromOtherName(objId, XCN_CRYPT_STRING_BINARY, value, true)
 					if err != nil {
-						return "", err
+						return err
 					}
 
 					err = altNames.Add(altName)
 					if err != nil {
-						return "", err
+						return err
 					}
 				}
 			}
 
 			extAltNames, err := x509.CX509ExtensionAlternativeNames()
 			if err != nil {
-				return "", err
+				return err
 			}
 
 			err = extAltNames.InitializeEncode(altNames)
 			if err != nil {
-				return "", err
+				return err
 			}
 
 			ext3, err := request.X509Extensions()
 			if err != nil {
-				return "", err
+				return err
 			}
 
 			err = ext3.Add((*cades.CX509Extension)(extAltNames))
 			if err != nil {
-				return "", err
+				return err
 			}
 		} else {
 			slog.Debug(fmt.Sprintf("CadesVersion: %+v", cadesVersion))
@@ -363,10 +414,47 @@ func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, err
 	}
 
 	if (hashAlgorithmOid == &cades.CObjectId{}) {
-		return "", fmt.Errorf("hashAlgorithmOid not found for provider: %s", params.ProviderName)
+		return fmt.Errorf("hashAlgorithmOid not found for provider: %s", params.ProviderName)
 	}
 
 	_, err = request.SetHashAlgorithm(hashAlgorithmOid)
+	if err != nil {
+		return err
+	}
+
+	if isCA {
+		err = addBasicConstraints(x509, request)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateCsr(x509 *cades.X509EnrollmentRoot, params *CsrParams) (string, error) {
+	pk, err := createPrivateKey(x509, params)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := x509.CX509CertificateRequestPkcs10()
+	if err != nil {
+		return "", err
+	}
+
+	err = request.InitializeFromPrivateKey(1, *(*cades.CadesObject)(pk), "")
+	if err != nil {
+		return "", err
+	}
+
+	if params.ChallengePassword != "" {
+		err = setProperty((*cades.CadesObject)(request), "ChallengePassword", params.ChallengePassword)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = initializeRequest(x509, request, params, false)
 	if err != nil {
 		return "", err
 	}
@@ -399,58 +487,9 @@ func dnToX500DistinguishedName(dn map[string]string) string {
 	return strings.Join(parts, ";")
 }
 
-func requestCertificate(csr string, params *Params) string {
-	client := http.Client{}
-	formData := url.Values{}
-	formData.Add("Mode", "newreq")
-	formData.Add("ThumbPrint", "")
-	formData.Add("TargetStoreFlags", "0")
-	formData.Add("SaveCert", "yes")
-	formData.Add("CertRequest", csr)
-
-	encodeData := formData.Encode()
-	uri := fmt.Sprintf("https://%s/certsrv/certfnsh.asp", *params.CA.Url)
-	request, _ := http.NewRequest(
-		"POST", uri, strings.NewReader(encodeData),
-	)
-	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := client.Do(request)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", uri, err.Error()))
-		return ""
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Cant read response, error: %s", err.Error()))
-		return ""
-	}
-
-	data := string(body)
-	requestId := CERT_REQUEST_ID_PATTERN.FindString(data)
-	if requestId == "" {
-		slog.Debug("RequestId not found")
-		return ""
-	}
-
-	certUri := fmt.Sprintf("https://%s/certsrv/certnew.cer?%sEnc=b64", *params.CA.Url, requestId)
-	resp, err = client.Get(certUri)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", certUri, err.Error()))
-		return ""
-	}
-	defer resp.Body.Close()
-
-	cert, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf("Cant read response, error: %s", err.Error()))
-		return ""
-	}
-
-	certData := string(cert)
-	return certData
+// csrToDer decodes the base64 csr returned by generateCsr.
+func csrToDer(csr string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(string(removePemArmor([]byte(csr))))
 }
 
 func installCertificate(x509 *cades.X509EnrollmentRoot, certificateData string) error {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// readCsrFile reads a PKCS#10 request in PEM, base64 or DER form and returns it as base64.
+func readCsrFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := pemToDer(data)
+	if err != nil {
+		der = data
+	}
+
+	request, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return "", fmt.Errorf("invalid csr file %s: %s", path, err.Error())
+	}
+
+	err = request.CheckSignature()
+	if err != nil && !errors.Is(err, x509.ErrUnsupportedAlgorithm) {
+		return "", fmt.Errorf("invalid csr signature %s: %s", path, err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+// csrFileName returns the name of a csr file request, container.name when set or the file name without extension.
+func csrFileName(csr *CsrParams) string {
+	if csr.Container.Name != "" {
+		return csr.Container.Name
+	}
+	name := filepath.Base(csr.CsrFile)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// SubmitCsrFile sends an existing csr to the CA without creating a container.
+// The issued certificate is saved as <name>.cer next to the csr copy and is not linked with any key.
+func SubmitCsrFile(ca CA, csr *CsrParams, params *Params) *ContainerInfo {
+	requestParams := *csr
+	name := csrFileName(csr)
+	result := &ContainerInfo{Request: &requestParams, Effective: newRequestParams(params)}
+
+	csrData, err := readCsrFile(csr.CsrFile)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant read csr file, request[%s], error: %s", name, err.Error()))
+		return result
+	}
+
+	outputFolder := containerOutputFolder(params, name)
+	if err := os.MkdirAll(outputFolder, os.ModePerm); err != nil {
+		slog.Error(fmt.Sprintf("Cant create folder: %s, error: %s", outputFolder, err.Error()))
+		return result
+	}
+
+	csrFilePath := filepath.Join(outputFolder, fmt.Sprintf("%s.csr", name))
+	err = os.WriteFile(csrFilePath, []byte(csrData), 0644)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", csrFilePath, err.Error()))
+	}
+	saveResolvedRequest(csr, name, outputFolder)
+
+	result.Name = name
+	if *params.SkipCSRRequest {
+		slog.Info(fmt.Sprintf("Request[%s] saved without sending to the CA", name))
+		return result
+	}
+
+	request, err := requestCertificate(ca, fmt.Sprintf("request[%s]", name), csrData, certAttributes(csr), &params.CA)
+	result.Attempts = request.Attempts
+	result.RequestId = request.Id
+	result.Status = request.Status
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant request certificate, request[%s], attempts: %d, error: %s", name, request.Attempts, err.Error()))
+
+		var caErr *CAError
+		if errors.As(err, &caErr) {
+			result.Error = caErr
+			result.Status = caErr.Status
+		}
+		return result
+	}
+
+	if request.Status == CAStatusPending {
+		slog.Warn(fmt.Sprintf("Certificate request[%s] is pending, request[%s] kept for resume", request.Id, name))
+		return result
+	}
+
+	err = checkIssuedCertificate(request.Certificate, csrData, result, params)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Issued certificate rejected, request[%s], error: %s", name, err.Error()))
+		return result
+	}
+
+	saveCsrFileCertificate(request.Certificate, result, outputFolder)
+	slog.Info(fmt.Sprintf("Certificate for request[%s] saved", name))
+	return result
+}
+
+// saveCsrFileCertificate saves the certificate of a csr file request and fills the thumbprint in info.
+func saveCsrFileCertificate(certificate string, info *ContainerInfo, outputFolder string) {
+	saveCertificateFile(certificate, info.Name, outputFolder)
+
+	thumbprint, err := getThumbprintFromBS64Certificate(certificate)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	info.Thumbprint = thumbprint
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	SourceTypeCSV = "csv"
+
+	EncodingAuto   = "auto"
+	EncodingUTF8   = "utf-8"
+	EncodingCP1251 = "cp1251"
+)
+
+// RequestSource describes requests loaded from an external file. Columns maps a column header
+// to the request field: dn.<name or OID>, san.<OID>, container.name, container.pin, template.
+type RequestSource struct {
+	Type      string            `json:"type"`
+	File      string            `json:"file"`
+	Delimiter string            `json:"delimiter,omitempty"`
+	Encoding  string            `json:"encoding,omitempty"`
+	Profile   string            `json:"profile,omitempty"`
+	Columns   map[string]string `json:"columns"`
+}
+
+// loadSources appends the requests of all config sources to config.Requests.
+func loadSources(config *Config) error {
+	for index, source := range config.Sources {
+		if source.Type != SourceTypeCSV {
+			return fmt.Errorf("sources[%d]: unknown source type %q", index, source.Type)
+		}
+
+		requests, err := loadCsvRequests(&source)
+		if err != nil {
+			return fmt.Errorf("sources[%d]: %s", index, err.Error())
+		}
+		config.Requests = append(config.Requests, requests...)
+	}
+	return nil
+}
+
+// loadCsvRequests reads a csv file with a header row, each following row is a request.
+// Empty cells are skipped, so inherited values of the profile are kept.
+func loadCsvRequests(source *RequestSource) ([]CsrParams, error) {
+	data, err := os.ReadFile(source.File)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = decodeCsv(data, source.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", source.File, err.Error())
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = csvDelimiter(data, source.Delimiter)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: cant read header: %s", source.File, err.Error())
+	}
+
+	targets := make([]string, len(header))
+	found := map[string]bool{}
+	for column, name := range header {
+		name = strings.TrimSpace(name)
+		if target, ok := source.Columns[name]; ok {
+			if err := checkCsvTarget(target); err != nil {
+				return nil, fmt.Errorf("%s: column %q: %s", source.File, name, err.Error())
+			}
+			targets[column] = target
+			found[name] = true
+		}
+	}
+	for name := range source.Columns {
+		if !found[name] {
+			return nil, fmt.Errorf("%s: column %q not found in header", source.File, name)
+		}
+	}
+
+	var requests []CsrParams
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", source.File, err.Error())
+		}
+
+		csr := CsrParams{Extends: source.Profile}
+		empty := true
+		for column, value := range record {
+			value = strings.TrimSpace(value)
+			if column >= len(targets) || targets[column] == "" || value == "" {
+				continue
+			}
+			setCsvValue(&csr, targets[column], value)
+			empty = false
+		}
+
+		if !empty {
+			requests = append(requests, csr)
+		}
+	}
+	return requests, nil
+}
+
+// decodeCsv converts the file to utf-8. Files saved by Russian Excel are in windows-1251,
+// auto picks it when the data is not valid utf-8.
+func decodeCsv(data []byte, encoding string) ([]byte, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	switch strings.ToLower(encoding) {
+	case "", EncodingAuto:
+		if utf8.Valid(data) {
+			return data, nil
+		}
+		return charmap.Windows1251.NewDecoder().Bytes(data)
+	case EncodingUTF8, "utf8":
+		if !utf8.Valid(data) {
+			return nil, errors.New("file is not valid utf-8")
+		}
+		return data, nil
+	case EncodingCP1251, "windows-1251":
+		return charmap.Windows1251.NewDecoder().Bytes(data)
+	}
+	return nil, fmt.Errorf("unknown encoding: %s", encoding)
+}
+
+// csvDelimiter returns the configured delimiter or the most frequent of ; , and tab in the header line.
+func csvDelimiter(data []byte, delimiter string) rune {
+	if delimiter != "" {
+		if delimiter == `\t` {
+			return '\t'
+		}
+		r, _ := utf8.DecodeRuneInString(delimiter)
+		return r
+	}
+
+	line := data
+	if end := bytes.IndexByte(data, '\n'); end >= 0 {
+		line = data[:end]
+	}
+
+	result, count := ';', 0
+	for _, candidate := range []rune{';', ',', '\t'} {
+		if n := bytes.Count(line, []byte(string(candidate))); n > count {
+			result, count = candidate, n
+		}
+	}
+	return result
+}
+
+func checkCsvTarget(target string) error {
+	switch {
+	case target == "container.name", target == "container.pin", target == "template":
+		return nil
+	case strings.HasPrefix(target, "dn.") && len(target) > len("dn."):
+		return nil
+	case strings.HasPrefix(target, "san.") && len(target) > len("san."):
+		return nil
+	}
+	return fmt.Errorf("unknown target %q, expected dn.<name>, san.<oid>, container.name, container.pin or template", target)
+}
+
+func setCsvValue(csr *CsrParams, target string, value string) {
+	switch {
+	case target == "container.name":
+		csr.Container.Name = value
+	case target == "container.pin":
+		csr.Container.Pin = value
+	case target == "template":
+		csr.Template = value
+	case strings.HasPrefix(target, "dn."):
+		if csr.Dn == nil {
+			csr.Dn = map[string]string{}
+		}
+		csr.Dn[strings.TrimPrefix(target, "dn.")] = value
+	case strings.HasPrefix(target, "san."):
+		if csr.SAN == nil {
+			csr.SAN = map[string][]string{}
+		}
+		oid := strings.TrimPrefix(target, "san.")
+		csr.SAN[oid] = append(csr.SAN[oid], value)
+	}
+}
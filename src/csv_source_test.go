@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCsv(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		encoding string
+		expected string
+		fails    bool
+	}{
+		{name: "auto utf-8", data: []byte("CN;Организация"), expected: "CN;Организация"},
+		{name: "auto utf-8 bom", data: []byte("\xef\xbb\xbfCN;Организация"), expected: "CN;Организация"},
+		{name: "auto cp1251", data: cp1251(t, "CN;Организация"), expected: "CN;Организация"},
+		{name: "cp1251", data: cp1251(t, "Иванов"), encoding: "windows-1251", expected: "Иванов"},
+		{name: "utf-8", data: []byte("Иванов"), encoding: "UTF-8", expected: "Иванов"},
+		{name: "invalid utf-8", data: cp1251(t, "Иванов"), encoding: EncodingUTF8, fails: true},
+		{name: "unknown encoding", data: []byte("CN"), encoding: "koi8-r", fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := decodeCsv(test.data, test.encoding)
+			if (err != nil) != test.fails {
+				t.Fatalf("decodeCsv() error = %v, expected error: %t", err, test.fails)
+			}
+			if string(result) != test.expected {
+				t.Errorf("decodeCsv() = %q, expected %q", result, test.expected)
+			}
+		})
+	}
+}
+
+func TestCsvDelimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		delimiter string
+		expected  rune
+	}{
+		{name: "semicolon", data: "CN;O;OU\nTest,1;Org;IT", expected: ';'},
+		{name: "comma", data: "CN,O,OU\nTest;1,Org,IT", expected: ','},
+		{name: "tab", data: "CN\tO\tOU\n", expected: '\t'},
+		{name: "single column", data: "CN\nTest", expected: ';'},
+		{name: "configured", data: "CN;O;OU", delimiter: "|", expected: '|'},
+		{name: "configured tab", data: "CN;O;OU", delimiter: `\t`, expected: '\t'},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := csvDelimiter([]byte(test.data), test.delimiter); result != test.expected {
+				t.Errorf("csvDelimiter(%q) = %q, expected %q", test.data, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoadCsvRequests(t *testing.T) {
+	columns := map[string]string{
+		"ФИО":     "dn.CN",
+		"СНИЛС":   "dn.1.2.643.100.3",
+		"Почта":   "san.1.2.840.113549.1.9.1",
+		"Почта 2": "san.1.2.840.113549.1.9.1",
+		"Ключ":    "container.name",
+		"Шаблон":  "template",
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		columns  map[string]string
+		expected []CsrParams
+		err      string
+	}{
+		{
+			name:    "column mapping",
+			data:    cp1251(t, "ФИО;СНИЛС;Почта;Почта 2;Ключ;Шаблон;Комментарий\r\n\"Иванов; Иван\";00000000000;a@ca.lan;b@ca.lan;KEY_1;User;skipped\r\n;;;;;;only comment\r\nПетров;;c@ca.lan;;KEY_2;;\r\n"),
+			columns: columns,
+			expected: []CsrParams{
+				{
+					Extends:   "user",
+					Template:  "User",
+					Container: Container{Name: "KEY_1"},
+					SAN:       map[string][]string{"1.2.840.113549.1.9.1": {"a@ca.lan", "b@ca.lan"}},
+					Dn:        map[string]string{"CN": "Иванов; Иван", "1.2.643.100.3": "00000000000"},
+				},
+				{
+					Extends:   "user",
+					Container: Container{Name: "KEY_2"},
+					SAN:       map[string][]string{"1.2.840.113549.1.9.1": {"c@ca.lan"}},
+					Dn:        map[string]string{"CN": "Петров"},
+				},
+			},
+		},
+		{
+			name:    "missing column",
+			data:    []byte("ФИО,Ключ\nИванов,KEY_1\n"),
+			columns: map[string]string{"ФИО": "dn.CN", "Почта": "san.1.2.840.113549.1.9.1"},
+			err:     `column "Почта" not found in header`,
+		},
+		{
+			name:    "unknown target",
+			data:    []byte("ФИО,Ключ\nИванов,KEY_1\n"),
+			columns: map[string]string{"Ключ": "container.pin2"},
+			err:     `column "Ключ": unknown target "container.pin2"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "requests.csv")
+			if err := os.WriteFile(path, test.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			requests, err := loadCsvRequests(&RequestSource{Type: SourceTypeCSV, File: path, Profile: "user", Columns: test.columns})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("loadCsvRequests() error = %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadCsvRequests() error = %v", err)
+			}
+			if !reflect.DeepEqual(requests, test.expected) {
+				t.Errorf("loadCsvRequests() = %+v, expected %+v", requests, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"time"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+)
+
+// createObject creates a plugin object that CryptoPro-Adapter does not wrap.
+func createObject(cadesObj *cades.Cades, name string) (*cades.CadesObject, error) {
+	body := &cades.CadesRequestBody{
+		Tabid: cadesObj.Id,
+		Data: &cades.CadesRequestData{
+			RequestId:   cadesObj.RequestId,
+			Destination: "nmcades",
+			Method:      "CreateObject",
+			Params: []cades.CadesParam{
+				{Type: "string", Value: name},
+			},
+		},
+	}
+
+	_, err := cadesObj.SendRequest(body)
+	if err != nil {
+		return &cades.CadesObject{}, err
+	}
+
+	cadesObj.ObjId++
+	object := cades.CadesObject{
+		Cades: cadesObj,
+		ObjId: cadesObj.ObjId,
+	}
+	return &object, nil
+}
+
+func setProperty(object *cades.CadesObject, name string, value any) error {
+	param := cades.ValueToParam(value)
+	_, err := cades.SetProperty(object, name, []cades.CadesParam{*param})
+	return err
+}
+
+func addBasicConstraints(x509 *cades.X509EnrollmentRoot, request *cades.CX509CertificateRequestPkcs10) error {
+	data, err := asn1.Marshal(struct {
+		IsCA bool
+	}{IsCA: true})
+	if err != nil {
+		return err
+	}
+
+	oid, err := x509.CObjectId()
+	if err != nil {
+		return err
+	}
+
+	err = oid.InitializeFromValue("2.5.29.19")
+	if err != nil {
+		return err
+	}
+
+	extension, err := x509.CX509Extension()
+	if err != nil {
+		return err
+	}
+
+	err = extension.Initialize(base64.StdEncoding.EncodeToString(data), *(*cades.CadesObject)(oid), XCN_CRYPT_STRING_BASE64)
+	if err != nil {
+		return err
+	}
+
+	err = setProperty((*cades.CadesObject)(extension), "Critical", true)
+	if err != nil {
+		return err
+	}
+
+	extensions, err := request.X509Extensions()
+	if err != nil {
+		return err
+	}
+
+	return extensions.Add(extension)
+}
+
+// generateSelfSignedCertificate creates a container and a self-signed certificate for it
+// using X509Enrollment.CX509CertificateRequestCertificate, the certificate is installed into the user store.
+func generateSelfSignedCertificate(x509 *cades.X509EnrollmentRoot, params *CsrParams, isCA bool, validity time.Duration) (string, error) {
+	pk, err := createPrivateKey(x509, params)
+	if err != nil {
+		return "", err
+	}
+
+	object, err := createObject(x509.Cades, "X509Enrollment.CX509CertificateRequestCertificate")
+	if err != nil {
+		return "", err
+	}
+
+	// CX509CertificateRequestCertificate shares the pkcs10 properties used by initializeRequest
+	request := (*cades.CX509CertificateRequestPkcs10)(object)
+	err = request.InitializeFromPrivateKey(ContextUser, *(*cades.CadesObject)(pk), "")
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = setProperty(object, "NotBefore", now.Add(-time.Minute))
+	if err != nil {
+		return "", err
+	}
+
+	err = setProperty(object, "NotAfter", now.Add(validity))
+	if err != nil {
+		return "", err
+	}
+
+	err = initializeRequest(x509, request, params, isCA)
+	if err != nil {
+		return "", err
+	}
+
+	enroll, err := x509.CX509Enrollment()
+	if err != nil {
+		return "", err
+	}
+
+	err = enroll.InitializeFromRequest(request)
+	if err != nil {
+		return "", err
+	}
+
+	certificate, err := enroll.CreateRequest(XCN_CRYPT_STRING_BASE64)
+	if err != nil {
+		return "", err
+	}
+
+	err = enroll.InstallResponse(ALLOW_UNTRUSTED_CERTIFICATE, certificate, XCN_CRYPT_STRING_BASE64, "")
+	if err != nil {
+		return "", err
+	}
+
+	der, err := base64.StdEncoding.DecodeString(string(removePemArmor([]byte(certificate))))
+	if err != nil {
+		return "", err
+	}
+	return derToPem(der), nil
+}
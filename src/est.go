@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+	"golang.org/x/exp/slog"
+)
+
+// ESTCA implements RFC 7030 enrollment over /.well-known/est.
+// EST has no request ids, so pending requests are tracked by csr hash
+// and resubmitted when their status is checked.
+type ESTCA struct {
+	url          string
+	label        string
+	client       *http.Client
+	pending      map[string]estPendingRequest
+	certificates map[string]string
+}
+
+// estPendingRequest is resubmitted to the same operation, so a pending re-enrollment stays a re-enrollment.
+type estPendingRequest struct {
+	operation string
+	csr       string
+}
+
+func NewESTCA(params *CAParams) (*ESTCA, error) {
+	client, err := newHTTPClient(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ESTCA{
+		url:          caBaseURL(params),
+		label:        params.EST.Label,
+		client:       client,
+		pending:      map[string]estPendingRequest{},
+		certificates: map[string]string{},
+	}, nil
+}
+
+func (ca *ESTCA) endpoint(operation string) string {
+	if ca.label == "" {
+		return fmt.Sprintf("%s/.well-known/est/%s", ca.url, operation)
+	}
+	return fmt.Sprintf("%s/.well-known/est/%s/%s", ca.url, ca.label, operation)
+}
+
+func (ca *ESTCA) do(request *http.Request) (int, []byte, error) {
+	resp, err := ca.client.Do(request)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", request.URL, err.Error()))
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Cant read response, error: %s", err.Error()))
+		return resp.StatusCode, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return resp.StatusCode, body, &HTTPStatusError{Url: request.URL.String(), StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return resp.StatusCode, body, nil
+}
+
+func (ca *ESTCA) enroll(operation string, csr string) (*CARequest, error) {
+	hash := sha1.Sum([]byte(csr))
+	requestId := hex.EncodeToString(hash[:])
+
+	request, err := http.NewRequest("POST", ca.endpoint(operation), strings.NewReader(csr))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Content-Type", "application/pkcs10")
+	request.Header.Add("Content-Transfer-Encoding", "base64")
+
+	statusCode, body, err := ca.do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if statusCode == http.StatusAccepted {
+		ca.pending[requestId] = estPendingRequest{operation: operation, csr: csr}
+		return &CARequest{Id: requestId, Status: CAStatusPending}, nil
+	}
+
+	certificates, err := parsePkcs7Certificates(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(certificates) == 0 {
+		return nil, ErrCertificateMissing
+	}
+
+	certificate := derToPem(certificates[0].Raw)
+	ca.certificates[requestId] = certificate
+	delete(ca.pending, requestId)
+	return &CARequest{Id: requestId, Status: CAStatusIssued, Certificate: certificate}, nil
+}
+
+func (ca *ESTCA) Submit(csr string) (*CARequest, error) {
+	return ca.enroll("simpleenroll", csr)
+}
+
+// Reenroll sends the csr to /simplereenroll, the client must be authenticated with the current certificate.
+func (ca *ESTCA) Reenroll(csr string) (*CARequest, error) {
+	return ca.enroll("simplereenroll", csr)
+}
+
+// RestorePending tracks the csr of a previous run again, requestId is the csr hash, so it must match.
+// Pending re-enrollments are restored as enrollments.
+func (ca *ESTCA) RestorePending(requestId string, csr string) error {
+	hash := sha1.Sum([]byte(csr))
+	if hex.EncodeToString(hash[:]) != requestId {
+		return fmt.Errorf("%w: csr does not match request[%s]", ErrRequestIdNotFound, requestId)
+	}
+	ca.pending[requestId] = estPendingRequest{operation: "simpleenroll", csr: csr}
+	return nil
+}
+
+func (ca *ESTCA) Status(requestId string) (CAStatus, error) {
+	if _, ok := ca.certificates[requestId]; ok {
+		return CAStatusIssued, nil
+	}
+
+	pending, ok := ca.pending[requestId]
+	if !ok {
+		return CAStatusUnknown, ErrRequestIdNotFound
+	}
+
+	request, err := ca.enroll(pending.operation, pending.csr)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+	return request.Status, nil
+}
+
+func (ca *ESTCA) Certificate(requestId string) (string, error) {
+	certificate, ok := ca.certificates[requestId]
+	if !ok {
+		return "", ErrCertificateMissing
+	}
+	return certificate, nil
+}
+
+func (ca *ESTCA) caCertificates() ([]*x509.Certificate, []byte, error) {
+	request, err := http.NewRequest("GET", ca.endpoint("cacerts"), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, body, err := ca.do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificates, err := parsePkcs7Certificates(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certificates, body, nil
+}
+
+func (ca *ESTCA) Root() (string, error) {
+	certificates, _, err := ca.caCertificates()
+	if err != nil {
+		return "", err
+	}
+	if len(certificates) == 0 {
+		return "", ErrCertificateMissing
+	}
+
+	for _, certificate := range certificates {
+		if bytes.Equal(certificate.RawSubject, certificate.RawIssuer) {
+			return derToPem(certificate.Raw), nil
+		}
+	}
+	return derToPem(certificates[len(certificates)-1].Raw), nil
+}
+
+func (ca *ESTCA) Chain() (string, error) {
+	_, body, err := ca.caCertificates()
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// parsePkcs7Certificates parses base64 (EST) or DER encoded certs-only PKCS#7.
+func parsePkcs7Certificates(data []byte) ([]*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(string(removePemArmor(data)))
+	if err != nil {
+		der = data
+	}
+
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, err
+	}
+	return p7.Certificates, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestTemplateData is available in the templates of dn, san and container.name.
+type RequestTemplateData struct {
+	// Index is the 0-based copy number within the request, Number is Index+1
+	Index  int
+	Number int
+	Count  int
+	// Position is the 0-based position of the copy in the expanded request list
+	Position int
+	UUID     string
+	Date     time.Time
+}
+
+// requestExpander renders request templates, uuids come from the seeded source when params.Seed is set.
+// Fields are rendered in a fixed order, so the same seed gives the same requests.
+type requestExpander struct {
+	random *rand.Rand
+	now    time.Time
+	funcs  template.FuncMap
+}
+
+func newRequestExpander(seed *int64) *requestExpander {
+	expander := &requestExpander{now: time.Now()}
+	if seed != nil && *seed != 0 {
+		expander.random = rand.New(rand.NewSource(*seed))
+	}
+
+	expander.funcs = template.FuncMap{
+		// pad 4 .Number -> 0007
+		"pad": func(width int, value int) string {
+			return fmt.Sprintf("%0*d", width, value)
+		},
+		// date "2006-01-02" -> the expansion date in the layout
+		"date": func(layout string) string {
+			return expander.now.Format(layout)
+		},
+		"uuid": expander.uuid,
+	}
+	return expander
+}
+
+func (e *requestExpander) uuid() string {
+	if e.random == nil {
+		return uuid.New().String()
+	}
+
+	id, err := uuid.NewRandomFromReader(e.random)
+	if err != nil {
+		return uuid.New().String()
+	}
+	return id.String()
+}
+
+func (e *requestExpander) render(path string, text string, data *RequestTemplateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New(path).Funcs(e.funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var result bytes.Buffer
+	err = tmpl.Execute(&result, data)
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// expandRequests replaces every request with count copies and renders the templates of
+// dn, san and container.name for each copy. Requests without count are rendered once.
+func expandRequests(config *Config) error {
+	expander := newRequestExpander(config.Params.Seed)
+
+	var requests []CsrParams
+	for index := range config.Requests {
+		csr := &config.Requests[index]
+		path := fmt.Sprintf("requests[%d]", index)
+
+		if csr.Count < 0 {
+			return fmt.Errorf("%s.count: negative value %d", path, csr.Count)
+		}
+		count := csr.Count
+		if count == 0 {
+			count = 1
+		}
+
+		for copyIndex := 0; copyIndex < count; copyIndex++ {
+			data := &RequestTemplateData{
+				Index:    copyIndex,
+				Number:   copyIndex + 1,
+				Count:    count,
+				Position: len(requests),
+				UUID:     expander.uuid(),
+				Date:     expander.now,
+			}
+
+			expanded, err := expandRequest(expander, path, csr, data)
+			if err != nil {
+				return err
+			}
+			requests = append(requests, expanded)
+		}
+	}
+
+	config.Requests = requests
+	return nil
+}
+
+func expandRequest(expander *requestExpander, path string, csr *CsrParams, data *RequestTemplateData) (CsrParams, error) {
+	var err error
+	result := *csr
+	result.Count = 0
+
+	result.Container.Name, err = expander.render(path+".container.name", csr.Container.Name, data)
+	if err != nil {
+		return result, err
+	}
+	if result.Container.Name == "" && result.CsrFile == "" && expander.random != nil {
+		// Same name format as createPrivateKey, but from the seeded uuid so runs are reproducible
+		result.Container.Name = fmt.Sprintf("TEST_%s", data.UUID)
+	}
+
+	if csr.Dn != nil {
+		result.Dn = make(map[string]string, len(csr.Dn))
+		for _, name := range sortedKeys(csr.Dn) {
+			result.Dn[name], err = expander.render(fmt.Sprintf("%s.dn.%s", path, name), csr.Dn[name], data)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if csr.SAN != nil {
+		result.SAN = make(map[string][]string, len(csr.SAN))
+		for _, oid := range sortedKeys(csr.SAN) {
+			for _, value := range csr.SAN[oid] {
+				value, err = expander.render(fmt.Sprintf("%s.san.%s", path, oid), value, data)
+				if err != nil {
+					return result, err
+				}
+				result.SAN[oid] = append(result.SAN[oid], value)
+			}
+		}
+	}
+	return result, nil
+}
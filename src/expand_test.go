@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+		err      string
+	}{
+		{
+			name: "count and templates",
+			config: `{"requests": [
+				{"container": {"name": "ONE"}, "dn": {"CN": "One"}},
+				{
+					"count": 3,
+					"container": {"name": "USER_{{pad 3 .Number}}"},
+					"san": {"1.2.840.113549.1.9.1": ["user{{.Index}}@ca.lan", "{{.Number}}of{{.Count}}@ca.lan"]},
+					"dn": {"CN": "User {{.Number}}", "OU": "{{.Position}}"}
+				}
+			]}`,
+			expected: `[
+				{"container": {"name": "ONE"}, "dn": {"CN": "One"}},
+				{"container": {"name": "USER_001"}, "san": {"1.2.840.113549.1.9.1": ["user0@ca.lan", "1of3@ca.lan"]}, "dn": {"CN": "User 1", "OU": "1"}},
+				{"container": {"name": "USER_002"}, "san": {"1.2.840.113549.1.9.1": ["user1@ca.lan", "2of3@ca.lan"]}, "dn": {"CN": "User 2", "OU": "2"}},
+				{"container": {"name": "USER_003"}, "san": {"1.2.840.113549.1.9.1": ["user2@ca.lan", "3of3@ca.lan"]}, "dn": {"CN": "User 3", "OU": "3"}}
+			]`,
+		},
+		{
+			name:     "date",
+			config:   `{"requests": [{"dn": {"CN": "{{date \"2006\"}}"}}]}`,
+			expected: `[{"dn": {"CN": "` + time.Now().Format("2006") + `"}}]`,
+		},
+		{
+			name:   "negative count",
+			config: `{"requests": [{"dn": {"CN": "One"}}, {"count": -1, "dn": {"CN": "Two"}}]}`,
+			err:    "requests[1].count: negative value -1",
+		},
+		{
+			name:   "unknown field",
+			config: `{"requests": [{"dn": {"CN": "{{.Name}}"}}]}`,
+			err:    "requests[0].dn.CN",
+		},
+		{
+			name:   "broken template",
+			config: `{"requests": [{"container": {"name": "{{pad 3}"}, "dn": {"CN": "One"}}]}`,
+			err:    "requests[0].container.name",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := initConfig([]byte(test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = expandRequests(config)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expandRequests() error = %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandRequests() error = %v", err)
+			}
+
+			expected, err := initConfig([]byte(`{"requests": ` + test.expected + `}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.Requests, expected.Requests) {
+				t.Errorf("expandRequests() = %+v, expected %+v", config.Requests, expected.Requests)
+			}
+		})
+	}
+}
+
+func TestExpandRequestsSeed(t *testing.T) {
+	const data = `{"params": {"seed": %d}, "requests": [
+		{"count": 2, "dn": {"CN": "{{uuid}}", "OU": "{{.UUID}}"}},
+		{"container": {"name": "NAMED"}, "dn": {"CN": "{{.UUID}}"}}
+	]}`
+
+	expand := func(seed int) []CsrParams {
+		t.Helper()
+		config, err := initConfig([]byte(fmt.Sprintf(data, seed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = expandRequests(config); err != nil {
+			t.Fatal(err)
+		}
+		return config.Requests
+	}
+
+	first, second := expand(42), expand(42)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("expandRequests() with the same seed = %+v and %+v", first, second)
+	}
+
+	if len(first) != 3 {
+		t.Fatalf("expandRequests() = %d requests, expected 3", len(first))
+	}
+	if first[0].Container.Name == first[1].Container.Name || !strings.HasPrefix(first[0].Container.Name, "TEST_") {
+		t.Errorf("generated container names = %q and %q, expected different TEST_<uuid>", first[0].Container.Name, first[1].Container.Name)
+	}
+	if first[0].Dn["CN"] == first[0].Dn["OU"] {
+		t.Errorf("uuid and .UUID are equal: %q", first[0].Dn["CN"])
+	}
+	if first[2].Container.Name != "NAMED" {
+		t.Errorf("container name = %q, expected NAMED", first[2].Container.Name)
+	}
+
+	if other := expand(43); reflect.DeepEqual(first, other) {
+		t.Errorf("expandRequests() with another seed = %+v, expected other uuids", other)
+	}
+}
@@ -9,9 +9,19 @@ import (
 func defaultHelpUsage() {
 	intro := `
 Использование:
-  masscsr [flags]`
+  masscsr [command] [flags]`
 	fmt.Fprintln(os.Stderr, intro)
 
+	commands := `
+Commands:
+  resume        Загрузить и установить сертификаты по запросам в статусе pending из info.json
+  renew         Перевыпустить сертификаты из info.json, срок действия которых истекает (см. -renew-before)
+  export-csr    Создать контейнеры и csr запросы без отправки в УЦ, записать manifest.json
+  import-certs  Установить выпущенные сертификаты из папки -certs в контейнеры из manifest.json
+  mock-ca       Запустить тестовый certsrv сервер с локальным УЦ (см. -listen, -mock-mode)
+  validate      Проверить файл -file без обращения к КриптоПро CSP и УЦ`
+	fmt.Fprintln(os.Stderr, commands)
+
 	fmt.Fprintln(os.Stderr, "\nFlags:")
 	flag.PrintDefaults()
 
@@ -10,24 +10,68 @@ import (
 	"golang.org/x/exp/slog"
 )
 
+const (
+	ROOT_CERTIFICATE_FILE = "cryptopro_ca.cer"
+	CHAIN_FILE            = "chain.p7b"
+)
+
 type ContainerInfo struct {
-	Name            string `json:"name"`
-	Thumbprint      string `json:"thumbprint,omitempty"`
-	ContainerName   string `json:"containerName,omitempty"`
-	ContainerPin    string `json:"containerPin,omitempty"`
-	ContainerFolder string `json:"containerFolder,omitempty"`
-	Exportable      bool   `json:"exportable"`
+	Name            string   `json:"name"`
+	Thumbprint      string   `json:"thumbprint,omitempty"`
+	ContainerName   string   `json:"containerName,omitempty"`
+	ContainerPin    string   `json:"containerPin,omitempty"`
+	ContainerFolder string   `json:"containerFolder,omitempty"`
+	Exportable      bool     `json:"exportable"`
+	RequestId       string   `json:"requestId,omitempty"`
+	Status          CAStatus `json:"status,omitempty"`
+	SelfSigned      bool     `json:"selfSigned,omitempty"`
+	Error           *CAError `json:"error,omitempty"`
+	Attempts        int      `json:"attempts,omitempty"`
+	Mismatches      []string `json:"mismatches,omitempty"`
+	// Effective keeps the params applied to the request after per-request overrides
+	Effective *RequestParams `json:"effective,omitempty"`
+	// Request keeps the original request parameters for renew
+	Request *CsrParams `json:"request,omitempty"`
 }
 
-func ExecuteCsrInstall(x509 *cades.X509EnrollmentRoot, csr *CsrParams, params *Params) *ContainerInfo {
+func ExecuteCsrInstall(x509 *cades.X509EnrollmentRoot, ca CA, csr *CsrParams, params *Params) *ContainerInfo {
+	if csr.CsrFile != "" {
+		return SubmitCsrFile(ca, csr, params)
+	}
+
 	cm := cades.CadesManager{}
-	result := &ContainerInfo{}
-	csrData, err := generateCsr(x509, csr)
-	if err != nil {
-		slog.Error(fmt.Sprintf("Cant generate csr request, container[%s], error: %s", csr.Container.Name, err.Error()))
-		return result
+	requestParams := *csr
+	result := &ContainerInfo{Request: &requestParams, Effective: newRequestParams(params)}
+	if csr.ChallengePassword == "" && *params.CA.Type == CATypeSCEP {
+		csr.ChallengePassword = params.CA.SCEP.Challenge
+	}
+
+	selfSigned := *params.SelfSigned
+	if csr.SelfSigned != nil && !params.exportCSR {
+		selfSigned = *csr.SelfSigned
 	}
 
+	var (
+		csrData     string
+		certificate string
+		err         error
+	)
+	if selfSigned {
+		certificate, err = generateSelfSignedCertificate(x509, csr, false, SELF_SIGNED_VALIDITY)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant generate self-signed certificate, container[%s], error: %s", csr.Container.Name, err.Error()))
+			return result
+		}
+	} else {
+		csrData, err = generateCsr(x509, csr)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant generate csr request, container[%s], error: %s", csr.Container.Name, err.Error()))
+			return result
+		}
+	}
+	// The container name is generated with the key, renew must reuse it
+	requestParams.Container.Name = csr.Container.Name
+
 	var outputFolder string
 	if params.OutputFolder == "" {
 		outputFolder = *outputFolderFlag
@@ -43,14 +87,17 @@ func ExecuteCsrInstall(x509 *cades.X509EnrollmentRoot, csr *CsrParams, params *P
 		}
 	}
 
-	csrFilename := fmt.Sprintf("%s.csr", csr.Container.Name)
-	csrFilePath := filepath.Join(outputFolder, csrFilename)
-	csrFile, err := os.Create(csrFilePath)
-	if err != nil {
-		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", csrFilePath, err.Error()))
+	if !selfSigned {
+		csrFilename := fmt.Sprintf("%s.csr", csr.Container.Name)
+		csrFilePath := filepath.Join(outputFolder, csrFilename)
+		csrFile, err := os.Create(csrFilePath)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", csrFilePath, err.Error()))
+		}
+		defer csrFile.Close()
+		csrFile.WriteString(csrData)
 	}
-	defer csrFile.Close()
-	csrFile.WriteString(csrData)
+	saveResolvedRequest(csr, csr.Container.Name, outputFolder)
 
 	container, err := cm.GetContainer(csr.Container.Name)
 	if err != nil {
@@ -67,10 +114,26 @@ func ExecuteCsrInstall(x509 *cades.X509EnrollmentRoot, csr *CsrParams, params *P
 		defer cm.DeleteContainer(container)
 	}
 
+	if selfSigned {
+		result.Name = csr.Container.Name
+		result.ContainerPin = csr.Container.Pin
+		result.Exportable = csr.Container.isExportable()
+		result.SelfSigned = true
+
+		saveCertificateFile(certificate, result.Name, outputFolder)
+		exportIssuedCertificate(certificate, container, result, outputFolder, params)
+		slog.Info(fmt.Sprintf("Container[%s] and self-signed certificate installed", csr.Container.Name))
+
+		if !*params.SkipStore {
+			result.ContainerName = container.ContainerName
+		}
+		return result
+	}
+
 	if *params.SkipCSRRequest {
 		result.Name = csr.Container.Name
 		result.ContainerPin = csr.Container.Pin
-		result.Exportable = csr.Container.Exportable
+		result.Exportable = csr.Container.isExportable()
 
 		if !*params.SkipStore {
 			result.ContainerName = container.ContainerName
@@ -79,74 +142,194 @@ func ExecuteCsrInstall(x509 *cades.X509EnrollmentRoot, csr *CsrParams, params *P
 		return result
 	}
 
-	certificate := requestCertificate(csrData, params)
-	if certificate == "" {
-		slog.Error(fmt.Sprintf("Cant request certificate, container[%s]", csr.Container.Name))
+	request, err := requestCertificate(ca, fmt.Sprintf("container[%s]", csr.Container.Name), csrData, certAttributes(csr), &params.CA)
+	result.Attempts = request.Attempts
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant request certificate, container[%s], attempts: %d, error: %s", csr.Container.Name, request.Attempts, err.Error()))
 		cm.DeleteContainer(container)
+		result.Name = csr.Container.Name
+		result.Status = request.Status
+
+		var caErr *CAError
+		if errors.As(err, &caErr) {
+			result.Error = caErr
+			result.Status = caErr.Status
+		}
 		return result
 	}
 
-	certFilename := fmt.Sprintf("%s.cer", csr.Container.Name)
-	certFilePath := filepath.Join(outputFolder, certFilename)
-	certFile, err := os.Create(certFilePath)
+	result.Name = csr.Container.Name
+	result.ContainerPin = csr.Container.Pin
+	result.Exportable = csr.Container.isExportable()
+	result.RequestId = request.Id
+	result.Status = request.Status
+
+	if request.Status == CAStatusPending {
+		slog.Warn(fmt.Sprintf("Certificate request[%s] is pending, container[%s] kept for resume", request.Id, csr.Container.Name))
+		if !*params.SkipStore {
+			result.ContainerName = container.ContainerName
+		}
+		return result
+	}
+
+	err = checkIssuedCertificate(request.Certificate, csrData, result, params)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", certFilePath, err.Error()))
+		slog.Error(fmt.Sprintf("Issued certificate rejected, container[%s], error: %s", csr.Container.Name, err.Error()))
+		cm.DeleteContainer(container)
+		setInstallError(result, request.Id, fmt.Sprintf("certificate rejected: %s", err.Error()))
+		return result
 	}
-	defer certFile.Close()
-	certFile.WriteString(certificate)
 
-	err = installCertificate(x509, certificate)
+	err = installIssuedCertificate(x509, request.Certificate, container, result, outputFolder, params)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Cant install certificate, container[%s], error: %s", csr.Container.Name, err.Error()))
 		cm.DeleteContainer(container)
+		setInstallError(result, request.Id, fmt.Sprintf("cant install certificate: %s", err.Error()))
 		return result
 	}
 
-	if csr.Container.Exportable {
-		pfxFilename := fmt.Sprintf("%s.pfx", csr.Container.Name)
+	slog.Info(fmt.Sprintf("Container[%s] and certificate installed", csr.Container.Name))
+
+	if !*params.SkipStore {
+		result.ContainerName = container.ContainerName
+	}
+	return result
+}
+
+// setInstallError marks a request issued by the CA but not installed, so info.json keeps it with the reason.
+func setInstallError(info *ContainerInfo, requestId string, reason string) {
+	info.Thumbprint = ""
+	info.Status = CAStatusUnknown
+	info.Error = &CAError{RequestId: requestId, Status: CAStatusUnknown, Disposition: reason}
+}
+
+// checkIssuedCertificate runs verifyCertificate unless params.SkipVerify is set and logs the diff for the container.
+// Subject and extension mismatches are an error only with params.StrictVerify.
+func checkIssuedCertificate(certificate string, csrData string, info *ContainerInfo, params *Params) error {
+	if *params.SkipVerify {
+		return nil
+	}
+
+	diff, err := verifyCertificate(certificate, csrData, params)
+	if err != nil {
+		return err
+	}
+
+	info.Mismatches = diff
+	for _, line := range diff {
+		slog.Warn(fmt.Sprintf("Container[%s] certificate mismatch: %s", info.Name, line))
+	}
+
+	if len(diff) > 0 && *params.StrictVerify {
+		return fmt.Errorf("certificate does not match the request, %d mismatches", len(diff))
+	}
+	return nil
+}
+
+// rootCertificatePath returns the root certificate file of the CA, named CAs get their own file.
+func rootCertificatePath(params *Params) string {
+	if params.CA.Name != "" {
+		return filepath.Join(params.OutputFolder, fmt.Sprintf("%s_ca.cer", params.CA.Name))
+	}
+	return filepath.Join(params.OutputFolder, ROOT_CERTIFICATE_FILE)
+}
+
+// chainPath returns the chain file of the CA, named CAs get their own file.
+func chainPath(params *Params) string {
+	if params.CA.Name != "" {
+		return filepath.Join(params.OutputFolder, fmt.Sprintf("%s_%s", params.CA.Name, CHAIN_FILE))
+	}
+	return filepath.Join(params.OutputFolder, CHAIN_FILE)
+}
+
+// containerOutputFolder returns the folder with the container files, the output folder itself in flat mode.
+func containerOutputFolder(params *Params, name string) string {
+	if *params.Flat {
+		return params.OutputFolder
+	}
+	return filepath.Join(params.OutputFolder, name)
+}
+
+// infoOutputFolder returns the container folder of an info.json entry, using the params effective for its request.
+func infoOutputFolder(params *Params, info *ContainerInfo) string {
+	if info.Effective == nil {
+		return containerOutputFolder(params, info.Name)
+	}
+	if info.Effective.Flat {
+		return info.Effective.OutputFolder
+	}
+	return filepath.Join(info.Effective.OutputFolder, info.Name)
+}
+
+// installIssuedCertificate saves the certificate next to the container, links it with the key,
+// exports pfx for exportable containers and fills the thumbprint in info.
+func installIssuedCertificate(x509 *cades.X509EnrollmentRoot, certificate string, container *cades.Container, info *ContainerInfo, outputFolder string, params *Params) error {
+	saveCertificateFile(certificate, info.Name, outputFolder)
+
+	err := installCertificate(x509, certificate)
+	if err != nil {
+		return err
+	}
+
+	exportIssuedCertificate(certificate, container, info, outputFolder, params)
+	return nil
+}
+
+func saveCertificateFile(certificate string, name string, outputFolder string) {
+	certFilename := fmt.Sprintf("%s.cer", name)
+	certFilePath := filepath.Join(outputFolder, certFilename)
+	certFile, err := os.Create(certFilePath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", certFilePath, err.Error()))
+		return
+	}
+	defer certFile.Close()
+	certFile.WriteString(certificate)
+}
+
+// exportIssuedCertificate exports pfx for exportable containers and fills the thumbprint in info
+// once the certificate is linked with the container.
+func exportIssuedCertificate(certificate string, container *cades.Container, info *ContainerInfo, outputFolder string, params *Params) {
+	cm := cades.CadesManager{}
+
+	if info.Exportable {
+		pfxFilename := fmt.Sprintf("%s.pfx", info.Name)
 		pfxFilePath := filepath.Join(outputFolder, pfxFilename)
 		pfxFilePath, _ = filepath.Abs(pfxFilePath)
 
 		if (container != &cades.Container{}) {
-			_, err = cm.ExportContainerToPfx(pfxFilePath, container.UniqueContainerName, csr.Container.Pin)
+			_, err := cm.ExportContainerToPfx(pfxFilePath, container.UniqueContainerName, info.ContainerPin)
 			if err != nil {
 				slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", pfxFilePath, err.Error()))
 			}
 		}
 	}
 
-	slog.Info(fmt.Sprintf("Container[%s] and certificate installed", csr.Container.Name))
-
-	result.Name = csr.Container.Name
-	result.ContainerPin = csr.Container.Pin
-	result.Exportable = csr.Container.Exportable
-
 	certThumbprint, err := getThumbprintFromBS64Certificate(certificate)
 	if err != nil {
 		slog.Error(err.Error())
 	} else {
-		result.Thumbprint = certThumbprint
+		info.Thumbprint = certThumbprint
 	}
 
 	if *params.SkipStore {
-		defer cm.DeleteCertificate(certThumbprint)
-	}
-
-	if !*params.SkipStore {
-		result.ContainerName = container.ContainerName
+		cm.DeleteCertificate(certThumbprint)
 	}
-	return result
 }
 
-func InstallRoot(cadesObj *cades.Cades, params *Params) {
-	rootCertificate := requestRootCertificate(params)
-	if rootCertificate == "" {
-		slog.Error("The root certificate could not be requested")
+func InstallRoot(cadesObj *cades.Cades, ca CA, params *Params) {
+	var rootCertificate string
+	_, err := withRetry(&params.CA.Retry, "root certificate", func() error {
+		var err error
+		rootCertificate, err = ca.Root()
+		return err
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("The root certificate could not be requested, error: %s", err.Error()))
 		return
 	}
 
-	cerFilename := "cryptopro_ca.cer"
-	cerFilePath := filepath.Join(params.OutputFolder, cerFilename)
+	cerFilePath := rootCertificatePath(params)
 	cerFile, err := os.Create(cerFilePath)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", cerFilePath, err.Error()))
@@ -179,30 +362,63 @@ func InstallRoot(cadesObj *cades.Cades, params *Params) {
 	}
 }
 
-// func InstallChain(cadesObj *cades.Cades, params *Params) {
-// 	chainData := requestChain(params)
-// 	if chainData == "" {
-// 		slog.Error("The certificate chain could not be requested")
-// 		return
-// 	}
-
-// 	chainFilename := "chain.p7b"
-// 	chainFilePath := filepath.Join(params.OutputFolder, chainFilename)
-// 	chainFile, err := os.Create(chainFilePath)
-// 	if err != nil {
-// 		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", chainFilePath, err.Error()))
-// 	}
-// 	chainFile.WriteString(chainData)
-// 	chainFile.Close()
-
-// 	if *params.SkipStore {
-// 		return
-// 	}
-
-// 	err = installChainCertificate(chainFilePath)
-// 	if err != nil {
-// 		slog.Error(fmt.Sprintf("Cant install certificate chain, error: %s", err.Error()))
-// 	} else {
-// 		slog.Info("The certificate chain is installed")
-// 	}
-// }
+// InstallChain saves the CA chain as chain.p7b and installs the self-signed root into ROOT
+// and intermediate certificates into the CA store, skipping already installed ones.
+func InstallChain(cadesObj *cades.Cades, ca CA, params *Params) {
+	var chainData string
+	_, err := withRetry(&params.CA.Retry, "certificate chain", func() error {
+		var err error
+		chainData, err = ca.Chain()
+		return err
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("The certificate chain could not be requested, error: %s", err.Error()))
+		return
+	}
+
+	chainFilePath := chainPath(params)
+	chainFile, err := os.Create(chainFilePath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", chainFilePath, err.Error()))
+	} else {
+		chainFile.WriteString(chainData)
+		chainFile.Close()
+	}
+
+	if *params.SkipStore {
+		return
+	}
+
+	certificates, err := parsePkcs7Certificates([]byte(chainData))
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant parse certificate chain, error: %s", err.Error()))
+		return
+	}
+
+	cm := cades.CadesManager{}
+	for _, certificate := range certificates {
+		storeName, certmgrStore := "CA", "uCA"
+		if isSelfSigned(certificate) {
+			storeName, certmgrStore = "ROOT", "uRoot"
+		}
+
+		certificateData := derToPem(certificate.Raw)
+		thumbprint, err := getThumbprintFromBS64Certificate(certificateData)
+		if err != nil {
+			continue
+		}
+
+		exists, _ := cm.IsCertificateExists(thumbprint, certmgrStore)
+		if exists {
+			slog.Debug(fmt.Sprintf("Certificate[%s] already installed in %s", thumbprint, storeName))
+			continue
+		}
+
+		err = installStoreCertificate(cadesObj, certificateData, storeName)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant install chain certificate[%s], error: %s", certificate.Subject.String(), err.Error()))
+		} else {
+			slog.Info(fmt.Sprintf("Installed chain certificate[%s] into %s", certificate.Subject.String(), storeName))
+		}
+	}
+}
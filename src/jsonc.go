@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// stripJSONC replaces // and /* */ comments and trailing commas with spaces, so the result is plain json.
+// Newlines and byte offsets are kept, positions in decoder errors point to the original file.
+func stripJSONC(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	blank := func(from, to int) {
+		for i := from; i < to; i++ {
+			if result[i] != '\n' && result[i] != '\r' {
+				result[i] = ' '
+			}
+		}
+	}
+
+	if bytes.HasPrefix(result, []byte("\xef\xbb\xbf")) {
+		blank(0, 3)
+	}
+
+	lastComma := -1
+	for i := 0; i < len(result); i++ {
+		switch c := result[i]; {
+		case c == '"':
+			lastComma = -1
+			for i++; i < len(result) && result[i] != '"'; i++ {
+				if result[i] == '\\' {
+					i++
+				}
+			}
+		case c == '/' && i+1 < len(result) && result[i+1] == '/':
+			end := bytes.IndexByte(result[i:], '\n')
+			if end < 0 {
+				end = len(result) - i
+			}
+			blank(i, i+end)
+			i += end - 1
+		case c == '/' && i+1 < len(result) && result[i+1] == '*':
+			end := bytes.Index(result[i+2:], []byte("*/"))
+			if end < 0 {
+				// Unterminated comment is left for the decoder to report
+				return result
+			}
+			blank(i, i+end+4)
+			i += end + 3
+		case c == ',':
+			lastComma = i
+		case c == '}' || c == ']':
+			if lastComma >= 0 {
+				blank(lastComma, lastComma+1)
+			}
+			lastComma = -1
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		default:
+			lastComma = -1
+		}
+	}
+	return result
+}
+
+// ConfigError is a config parse error with the position in the file.
+type ConfigError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// newConfigError converts decoder errors of data into ConfigError, other errors are only prefixed with the file.
+// Offsets of json errors are used as is, fields of yaml and toml configs are looked up by name.
+func newConfigError(file string, format string, data []byte, err error) *ConfigError {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	result := &ConfigError{File: file, Message: err.Error()}
+	switch {
+	case errors.As(err, &syntaxErr):
+		result.Line, result.Column = offsetPosition(data, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			result.Message = fmt.Sprintf("field %s: cannot use %s as %s", typeErr.Field, typeErr.Value, typeErr.Type.String())
+		}
+		if format == ConfigFormatJSON {
+			result.Line, result.Column = offsetPosition(data, typeErr.Offset)
+		} else if typeErr.Field != "" {
+			fields := strings.Split(typeErr.Field, ".")
+			result.Line, result.Column = keyPosition(data, format, fields[len(fields)-1])
+		}
+	default:
+		if match := JSON_UNKNOWN_FIELD_PATTERN.FindStringSubmatch(err.Error()); match != nil {
+			result.Message = fmt.Sprintf("unknown field %q", match[1])
+			result.Line, result.Column = keyPosition(data, format, match[1])
+		}
+	}
+	return result
+}
+
+// offsetPosition returns 1-based line and column of the byte before offset, columns are counted in characters.
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		offset--
+	}
+
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return line, utf8.RuneCount(before[lineStart:]) + 1
+}
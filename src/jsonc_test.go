@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestStripJSONC(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{
+			name:     "plain json",
+			data:     `{"a": [1, 2], "b": "c"}`,
+			expected: `{"a": [1, 2], "b": "c"}`,
+		},
+		{
+			name:     "line comment",
+			data:     "{\n\"a\": 1 // comment\n}",
+			expected: "{\n\"a\": 1           \n}",
+		},
+		{
+			name:     "line comment at the end",
+			data:     `{"a": 1} // comment`,
+			expected: `{"a": 1}           `,
+		},
+		{
+			name:     "block comment keeps newlines",
+			data:     "{/* one\ntwo */\"a\": 1}",
+			expected: "{      \n      \"a\": 1}",
+		},
+		{
+			name:     "comments inside strings",
+			data:     `{"url": "http://ca.lan/certsrv", "dn": "/* CN */"}`,
+			expected: `{"url": "http://ca.lan/certsrv", "dn": "/* CN */"}`,
+		},
+		{
+			name:     "escaped quote inside string",
+			data:     `{"a": "say \"// hi\"", "b": 1,}`,
+			expected: `{"a": "say \"// hi\"", "b": 1 }`,
+		},
+		{
+			name:     "trailing commas",
+			data:     `{"a": [1, 2,], "b": {"c": 3,},}`,
+			expected: `{"a": [1, 2 ], "b": {"c": 3 } }`,
+		},
+		{
+			name:     "trailing comma before comment",
+			data:     "{\"a\": 1, // comment\n}",
+			expected: "{\"a\": 1            \n}",
+		},
+		{
+			name:     "commas inside strings",
+			data:     `{"a": "1,]", "b": ",}"}`,
+			expected: `{"a": "1,]", "b": ",}"}`,
+		},
+		{
+			name:     "comma before value is kept",
+			data:     `[1, /* two */ 2]`,
+			expected: `[1,           2]`,
+		},
+		{
+			name:     "unterminated block comment",
+			data:     `{"a": 1, /* comment`,
+			expected: `{"a": 1, /* comment`,
+		},
+		{
+			name:     "bom",
+			data:     "\xef\xbb\xbf{}",
+			expected: "   {}",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := string(stripJSONC([]byte(test.data)))
+			if result != test.expected {
+				t.Errorf("stripJSONC(%q) = %q, expected %q", test.data, result, test.expected)
+			}
+		})
+	}
+}
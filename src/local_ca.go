@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	"go.mozilla.org/pkcs7"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	LOCAL_CA_CERTIFICATE_FILE = "local_ca.cer"
+	LOCAL_CA_CONTAINER_NAME   = "masscsr_local_ca"
+)
+
+var (
+	oidGost2012PublicKey256   = asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 1, 1}
+	oidGost2012PublicKey512   = asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 1, 2}
+	oidGost2012Signature256   = asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 3, 2}
+	oidGost2012Signature512   = asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 3, 3}
+	oidSubjectKeyIdentifier   = asn1.ObjectIdentifier{2, 5, 29, 14}
+	oidAuthorityKeyIdentifier = asn1.ObjectIdentifier{2, 5, 29, 35}
+)
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type validity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+type tbsCertificate struct {
+	Version            int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           validity
+	Subject            asn1.RawValue
+	PublicKey          asn1.RawValue
+	Extensions         []pkix.Extension `asn1:"optional,explicit,tag:3"`
+}
+
+type certificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+type authorityKeyIdentifier struct {
+	KeyIdentifier []byte `asn1:"optional,tag:0"`
+}
+
+// LocalCA issues certificates without network access. The CA key lives in a CSP container,
+// the TBS part of certificates is built here and signed with CAdESCOM.RawSignature,
+// so GOST R 34.10-2012 signatures are produced by the CSP itself.
+type LocalCA struct {
+	cades         *cades.Cades
+	certificate   *x509.Certificate
+	signer        *cades.Certificate
+	hashAlgorithm int
+	signatureOid  asn1.ObjectIdentifier
+	validity      time.Duration
+	issued        map[string]string
+}
+
+func NewLocalCA(cadesObj *cades.Cades, params *CAParams) (*LocalCA, error) {
+	folder := params.Local.Folder
+	if _, err := os.Stat(folder); errors.Is(err, os.ErrNotExist) {
+		os.MkdirAll(folder, os.ModePerm)
+	}
+
+	validityDays := params.Local.ValidityDays
+	if validityDays <= 0 {
+		validityDays = 365
+	}
+
+	certificatePath := filepath.Join(folder, LOCAL_CA_CERTIFICATE_FILE)
+	certificateData, err := os.ReadFile(certificatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		certificateData, err = createLocalCA(cadesObj, params)
+	} else if err == nil {
+		err = loadLocalCA(certificateData, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := base64.StdEncoding.DecodeString(string(removePemArmor(certificateData)))
+	if err != nil {
+		return nil, err
+	}
+
+	caCertificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	var publicKey subjectPublicKeyInfo
+	_, err = asn1.Unmarshal(caCertificate.RawSubjectPublicKeyInfo, &publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &LocalCA{
+		cades:       cadesObj,
+		certificate: caCertificate,
+		validity:    time.Duration(validityDays) * 24 * time.Hour,
+		issued:      map[string]string{},
+	}
+
+	switch {
+	case publicKey.Algorithm.Algorithm.Equal(oidGost2012PublicKey256):
+		ca.hashAlgorithm = cades.CADESCOM_HASH_ALGORITHM_CP_GOST_3411_2012_256
+		ca.signatureOid = oidGost2012Signature256
+	case publicKey.Algorithm.Algorithm.Equal(oidGost2012PublicKey512):
+		ca.hashAlgorithm = cades.CADESCOM_HASH_ALGORITHM_CP_GOST_3411_2012_512
+		ca.signatureOid = oidGost2012Signature512
+	default:
+		return nil, fmt.Errorf("local CA key algorithm %s: %w", publicKey.Algorithm.Algorithm, ErrNotSupported)
+	}
+
+	thumbprint, err := getThumbprintFromBS64Certificate(string(certificateData))
+	if err != nil {
+		return nil, err
+	}
+
+	ca.signer, err = findCertificate(cadesObj, thumbprint)
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// createLocalCA generates the CA container with a self-signed certificate
+// and keeps both in the local CA folder.
+func createLocalCA(cadesObj *cades.Cades, params *CAParams) ([]byte, error) {
+	containerName := params.Local.ContainerName
+	if containerName == "" {
+		containerName = LOCAL_CA_CONTAINER_NAME
+	}
+
+	dn := params.Local.Dn
+	if len(dn) == 0 {
+		dn = map[string]string{
+			"CN": "Masscsr Local Test CA",
+			"O":  "Masscsr",
+			"C":  "RU",
+		}
+	}
+
+	exportable := true
+	keyUsage := XCN_CERT_DIGITAL_SIGNATURE_KEY_USAGE | XCN_CERT_KEY_CERT_SIGN_KEY_USAGE | XCN_CERT_CRL_SIGN_KEY_USAGE
+	csrParams := &CsrParams{
+		EKUKeyUsageFlags: &keyUsage,
+		Container: Container{
+			Name:       containerName,
+			Exportable: &exportable,
+		},
+		Dn: dn,
+	}
+
+	x509 := cades.CreateX509EnrollmentRoot(cadesObj)
+	certificate, err := generateSelfSignedCertificate(x509, csrParams, true, 10*365*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	certificatePath := filepath.Join(params.Local.Folder, LOCAL_CA_CERTIFICATE_FILE)
+	err = os.WriteFile(certificatePath, []byte(certificate), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = SaveContainerToDisk(params.Local.Folder, containerName)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant copy container: %s, error: %s", containerName, err.Error()))
+	}
+
+	slog.Info(fmt.Sprintf("Local CA created in %s", params.Local.Folder))
+	return []byte(certificate), nil
+}
+
+// loadLocalCA installs the saved CA container and links the certificate with it
+// when the CA certificate is not in the user store yet.
+func loadLocalCA(certificateData []byte, params *CAParams) error {
+	cm := cades.CadesManager{}
+	thumbprint, err := getThumbprintFromBS64Certificate(string(certificateData))
+	if err != nil {
+		return err
+	}
+
+	exists, _ := cm.IsCertificateExists(thumbprint, "uMy")
+	if exists {
+		return nil
+	}
+
+	entries, err := os.ReadDir(params.Local.Folder)
+	if err != nil {
+		return err
+	}
+
+	var containerFolderPath string
+	for _, entry := range entries {
+		if entry.IsDir() && CONTAINER_FOLDER.MatchString(entry.Name()) {
+			containerFolderPath = filepath.Join(params.Local.Folder, entry.Name())
+			break
+		}
+	}
+	if containerFolderPath == "" {
+		return fmt.Errorf("local CA container not found in %s", params.Local.Folder)
+	}
+
+	containersRoot, err := GetContainersRoot()
+	if err != nil {
+		return err
+	}
+
+	containerName := params.Local.ContainerName
+	if containerName == "" {
+		containerName = LOCAL_CA_CONTAINER_NAME
+	}
+
+	container, err := cm.InstallContainerFromFolder(containerFolderPath, containersRoot, "", containerName)
+	if err != nil && !errors.Is(err, cades.ErrContainerExists) {
+		return err
+	}
+
+	certificatePath := filepath.Join(params.Local.Folder, LOCAL_CA_CERTIFICATE_FILE)
+	_, err = cm.LinkCertWithContainer(certificatePath, container.ContainerName)
+	if err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("Local CA loaded from %s", params.Local.Folder))
+	return nil
+}
+
+func findCertificate(cadesObj *cades.Cades, thumbprint string) (*cades.Certificate, error) {
+	store, err := cades.NewStore(cadesObj)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	err = store.Open(cades.CAPICOM_CURRENT_USER_STORE, cades.CAPICOM_MY_STORE, cades.CAPICOM_STORE_OPEN_MAXIMUM_ALLOWED)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates, err := store.Certificates()
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := certificates.Find(cades.CAPICOM_CERTIFICATE_FIND_SHA1_HASH, thumbprint)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := found.Count()
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("certificate %s not found in the user store", thumbprint)
+	}
+
+	return found.Item(1)
+}
+
+// sign hashes data with GOST R 34.11-2012 and signs the hash with the CA key.
+func (ca *LocalCA) sign(data []byte) ([]byte, error) {
+	hashedData, err := createObject(ca.cades, "CAdESCOM.HashedData")
+	if err != nil {
+		return nil, err
+	}
+
+	err = setProperty(hashedData, "Algorithm", ca.hashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setProperty(hashedData, "DataEncoding", cades.CADESCOM_BASE64_TO_BINARY)
+	if err != nil {
+		return nil, err
+	}
+
+	param := cades.ValueToParam(base64.StdEncoding.EncodeToString(data))
+	err = cades.CallVoidMethod(hashedData, "Hash", []cades.CadesParam{*param})
+	if err != nil {
+		return nil, err
+	}
+
+	rawSignature, err := createObject(ca.cades, "CAdESCOM.RawSignature")
+	if err != nil {
+		return nil, err
+	}
+
+	params := []cades.CadesParam{
+		*cades.ValueToParam(*hashedData),
+		*cades.ValueToParam(*(*cades.CadesObject)(ca.signer)),
+	}
+	response, err := cades.CallMethod(rawSignature, "SignHash", params)
+	if err != nil {
+		return nil, err
+	}
+
+	signatureHex, ok := response.ReturnValue.Value.(string)
+	if !ok {
+		return nil, cades.ErrEmpty
+	}
+
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return nil, err
+	}
+
+	// CryptoAPI returns the signature in little-endian order, certificates keep it reversed
+	for i, j := 0, len(signature)-1; i < j; i, j = i+1, j-1 {
+		signature[i], signature[j] = signature[j], signature[i]
+	}
+	return signature, nil
+}
+
+func keyIdentifier(rawSubjectPublicKeyInfo []byte) ([]byte, error) {
+	var publicKey subjectPublicKeyInfo
+	_, err := asn1.Unmarshal(rawSubjectPublicKeyInfo, &publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum(publicKey.PublicKey.Bytes)
+	return hash[:], nil
+}
+
+// issue builds a certificate for the csr public key, subject and requested extensions.
+func (ca *LocalCA) issue(request *x509.CertificateRequest) ([]byte, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	subjectKeyId, err := keyIdentifier(request.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	authorityKeyId := ca.certificate.SubjectKeyId
+	if len(authorityKeyId) == 0 {
+		authorityKeyId, err = keyIdentifier(ca.certificate.RawSubjectPublicKeyInfo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var extensions []pkix.Extension
+	for _, extension := range request.Extensions {
+		if extension.Id.Equal(oidSubjectKeyIdentifier) || extension.Id.Equal(oidAuthorityKeyIdentifier) {
+			continue
+		}
+		extensions = append(extensions, extension)
+	}
+
+	subjectKeyIdValue, err := asn1.Marshal(subjectKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	authorityKeyIdValue, err := asn1.Marshal(authorityKeyIdentifier{KeyIdentifier: authorityKeyId})
+	if err != nil {
+		return nil, err
+	}
+
+	extensions = append(extensions,
+		pkix.Extension{Id: oidSubjectKeyIdentifier, Value: subjectKeyIdValue},
+		pkix.Extension{Id: oidAuthorityKeyIdentifier, Value: authorityKeyIdValue},
+	)
+
+	now := time.Now().UTC()
+	notAfter := now.Add(ca.validity)
+	if notAfter.After(ca.certificate.NotAfter) {
+		notAfter = ca.certificate.NotAfter
+	}
+
+	signatureAlgorithm := pkix.AlgorithmIdentifier{Algorithm: ca.signatureOid}
+	tbs, err := asn1.Marshal(tbsCertificate{
+		Version:            2,
+		SerialNumber:       serialNumber,
+		SignatureAlgorithm: signatureAlgorithm,
+		Issuer:             asn1.RawValue{FullBytes: ca.certificate.RawSubject},
+		Validity:           validity{NotBefore: now.Add(-time.Minute), NotAfter: notAfter},
+		Subject:            asn1.RawValue{FullBytes: request.RawSubject},
+		PublicKey:          asn1.RawValue{FullBytes: request.RawSubjectPublicKeyInfo},
+		Extensions:         extensions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := ca.sign(tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(certificate{
+		TBSCertificate:     asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: signatureAlgorithm,
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+}
+
+func (ca *LocalCA) Submit(csr string) (*CARequest, error) {
+	csrDer, err := csrToDer(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := ca.issue(request)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	requestId := hex.EncodeToString(certificate.SerialNumber.Bytes())
+	ca.issued[requestId] = derToPem(der)
+	return &CARequest{Id: requestId, Status: CAStatusIssued, Certificate: ca.issued[requestId]}, nil
+}
+
+func (ca *LocalCA) Status(requestId string) (CAStatus, error) {
+	if _, ok := ca.issued[requestId]; ok {
+		return CAStatusIssued, nil
+	}
+	return CAStatusUnknown, ErrRequestIdNotFound
+}
+
+func (ca *LocalCA) Certificate(requestId string) (string, error) {
+	certificate, ok := ca.issued[requestId]
+	if !ok {
+		return "", ErrCertificateMissing
+	}
+	return certificate, nil
+}
+
+func (ca *LocalCA) Root() (string, error) {
+	return derToPem(ca.certificate.Raw), nil
+}
+
+func (ca *LocalCA) Chain() (string, error) {
+	degenerate, err := pkcs7.DegenerateCertificate(ca.certificate.Raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(degenerate), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -8,22 +9,44 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
 	"golang.org/x/exp/slog"
 )
 
 var (
-	debugFlag    *bool
-	flatFlag     *bool
-	skipRootFlag *bool
-	// installChainFlag   *bool
-	skipStoreFlag      *bool
-	skipCSRRequestFlag *bool
-	versionFlag        *bool
-	csrFileFlag        *string
-	caUrlFlag          *string
-	outputFolderFlag   *string
+	debugFlag            *bool
+	flatFlag             *bool
+	skipRootFlag         *bool
+	installChainFlag     *bool
+	installCRLFlag       *bool
+	skipStoreFlag        *bool
+	skipCSRRequestFlag   *bool
+	selfSignedFlag       *bool
+	skipVerifyFlag       *bool
+	strictVerifyFlag     *bool
+	versionFlag          *bool
+	csrFileFlag          *string
+	certsFolderFlag      *string
+	caUrlFlag            *string
+	caTypeFlag           *string
+	pendingTimeoutFlag   *time.Duration
+	pendingIntervalFlag  *time.Duration
+	caTimeoutFlag        *time.Duration
+	retryAttemptsFlag    *int
+	retryBackoffFlag     *time.Duration
+	rateLimitFlag        *float64
+	batchSizeFlag        *int
+	batchIntervalFlag    *time.Duration
+	renewBeforeFlag      *time.Duration
+	seedFlag             *int64
+	outputFolderFlag     *string
+	formatFlag           *string
+	listenFlag           *string
+	mockModeFlag         *string
+	mockPendingDelayFlag *time.Duration
 )
 
 func init() {
@@ -31,37 +54,155 @@ func init() {
 	versionFlag = flag.Bool("version", false, "Отобразить версию программы")
 	skipRootFlag = flag.Bool("skip-root", false, "Пропустить этап загрузки и установки корневого сертификата УЦ")
 	skipStoreFlag = flag.Bool("skip-store", false, "Не сохранять корневой сертификата УЦ и ЭЦП в хранилище")
-	// installChainFlag = flag.Bool("install-chain", false, "Загрузка и установка цепочки сертификатов УЦ")
+	installChainFlag = flag.Bool("install-chain", false, "Загрузка и установка цепочки сертификатов УЦ")
+	installCRLFlag = flag.Bool("install-crl", false, "Загрузка и установка списков отзыва (CRL) УЦ и выпущенных сертификатов")
 	skipCSRRequestFlag = flag.Bool("skip-csr-request", false, "Пропустить отправку запроса на выпуск сертификата")
+	selfSignedFlag = flag.Bool("self-signed", false, "Создавать самоподписанные сертификаты вместо запроса в УЦ")
+	skipVerifyFlag = flag.Bool("skip-verify", false, "Не проверять выпущенный сертификат перед установкой")
+	strictVerifyFlag = flag.Bool("strict-verify", false, "Не устанавливать сертификат, если субъект или расширения отличаются от запроса")
 	flatFlag = flag.Bool("flat", false, "Не сохранять контейнер/сертификат/csr запрос в отдельной папке")
 
-	csrFileFlag = flag.String("file", "csr.json", "JSON файл с csr запросами")
-	caUrlFlag = flag.String("ca-url", "testgost2012.cryptopro.ru", "Доменное имя УЦ")
+	csrFileFlag = flag.String("file", "csr.json", "Файл с csr запросами (json, yaml, toml)")
+	formatFlag = flag.String("format", "", "Формат файла -file (json, yaml, toml), по умолчанию определяется по расширению")
+	caUrlFlag = flag.String("ca-url", "testgost2012.cryptopro.ru", "Доменное имя или базовый URL УЦ")
+	caTypeFlag = flag.String("ca-type", CATypeCertsrv, "Тип УЦ (certsrv, est, scep, local)")
+	pendingTimeoutFlag = flag.Duration("pending-timeout", 0, "Время ожидания выпуска сертификата по запросу в статусе pending")
+	pendingIntervalFlag = flag.Duration("pending-interval", 10*time.Second, "Интервал проверки статуса запроса в статусе pending")
+	caTimeoutFlag = flag.Duration("ca-timeout", 0, "Время ожидания ответа УЦ на один запрос")
+	retryAttemptsFlag = flag.Int("retry-attempts", 3, "Количество попыток запроса к УЦ при сетевых ошибках и ответах 5xx")
+	retryBackoffFlag = flag.Duration("retry-backoff", 2*time.Second, "Начальная задержка между попытками, удваивается после каждой неудачи")
+	rateLimitFlag = flag.Float64("rate-limit", 0, "Максимальное количество запросов к УЦ в секунду, 0 - без ограничения")
+	batchSizeFlag = flag.Int("batch-size", 0, "Количество csr запросов в одной партии, 0 - без разбиения на партии")
+	batchIntervalFlag = flag.Duration("batch-interval", time.Minute, "Пауза между партиями csr запросов")
+	renewBeforeFlag = flag.Duration("renew-before", 30*24*time.Hour, "Перевыпускать сертификаты, срок действия которых истекает в течение указанного времени (renew)")
+	seedFlag = flag.Int64("seed", 0, "Начальное значение генератора uuid в шаблонах запросов (count), 0 - случайное")
+	certsFolderFlag = flag.String("certs", "issued", "Директория с выпущенными сертификатами (.cer/.p7b) для import-certs")
 	outputFolderFlag = flag.String("folder", "test_certs", "Директория сохранения контейнеров/сертификатов/csr запросов")
+	listenFlag = flag.String("listen", "127.0.0.1:8080", "Адрес, на котором mock-ca принимает запросы")
+	mockModeFlag = flag.String("mock-mode", MockModeIssue, "Ответ mock-ca на запросы (issue, pending, denied, malformed)")
+	mockPendingDelayFlag = flag.Duration("mock-pending-delay", 30*time.Second, "Через сколько mock-ca выпускает сертификат по запросу в статусе pending")
 }
 
 type Config struct {
+	// Schema is the json schema reference used by editors, see csr.schema.json
+	Schema   string      `json:"$schema,omitempty"`
 	Requests []CsrParams `json:"requests"`
 	Params   Params      `json:"params,omitempty"`
+	// Defaults are applied to every request, Profiles only to the requests that extend them
+	Defaults *CsrParams           `json:"defaults,omitempty"`
+	Profiles map[string]CsrParams `json:"profiles,omitempty"`
+	// Sources add requests from external files, e.g. csv exported from Excel
+	Sources []RequestSource `json:"sources,omitempty"`
 }
 
 type CAParams struct {
-	Url *string `json:"url"`
+	Name               string        `json:"name,omitempty"`
+	Type               *string       `json:"type"`
+	Url                *string       `json:"url"`
+	PendingTimeout     *Duration     `json:"pendingTimeout"`
+	PendingInterval    *Duration     `json:"pendingInterval"`
+	CABundle           string        `json:"caBundle,omitempty"`
+	InsecureSkipVerify bool          `json:"insecureSkipVerify,omitempty"`
+	Proxy              string        `json:"proxy,omitempty"`
+	Timeout            *Duration     `json:"timeout"`
+	ConnectTimeout     *Duration     `json:"connectTimeout,omitempty"`
+	RateLimit          *float64      `json:"rateLimit"`
+	Retry              RetryParams   `json:"retry,omitempty"`
+	Auth               AuthParams    `json:"auth,omitempty"`
+	EST                ESTParams     `json:"est,omitempty"`
+	SCEP               SCEPParams    `json:"scep,omitempty"`
+	Local              LocalCAParams `json:"local,omitempty"`
+}
+
+type AuthParams struct {
+	Type         string `json:"type,omitempty"`
+	Username     string `json:"username,omitempty"`
+	UsernameEnv  string `json:"usernameEnv,omitempty"`
+	PasswordEnv  string `json:"passwordEnv,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	ClientCert   string `json:"clientCert,omitempty"`
+	ClientKey    string `json:"clientKey,omitempty"`
+}
+
+type RetryParams struct {
+	Attempts   *int      `json:"attempts"`
+	Backoff    *Duration `json:"backoff"`
+	MaxBackoff *Duration `json:"maxBackoff"`
+}
+
+type ESTParams struct {
+	Label string `json:"label,omitempty"`
+}
+
+type LocalCAParams struct {
+	Folder        string            `json:"folder,omitempty"`
+	ContainerName string            `json:"containerName,omitempty"`
+	Dn            map[string]string `json:"dn,omitempty"`
+	ValidityDays  int               `json:"validityDays,omitempty"`
+}
+
+type SCEPParams struct {
+	Path      string `json:"path,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+}
+
+// Duration accepts both "1m30s" strings and a number of seconds in json.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value any
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		d.Duration = time.Duration(v * float64(time.Second))
+	case string:
+		d.Duration, err = time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid duration: %s", string(data))
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
 }
 
 type Params struct {
-	Flat           *bool `json:"flat"`
-	SkipRoot       *bool `json:"skipRoot"`
-	SkipStore      *bool `json:"skipStore"`
-	SkipCSRRequest *bool `json:"skipCSRRequest"`
-	// InstallChain   *bool    `json:"installChain"`
-	OutputFolder string   `json:"outputFolder"`
-	CA           CAParams `json:"ca"`
+	Flat           *bool     `json:"flat"`
+	SkipRoot       *bool     `json:"skipRoot"`
+	SkipStore      *bool     `json:"skipStore"`
+	SkipCSRRequest *bool     `json:"skipCSRRequest"`
+	SelfSigned     *bool     `json:"selfSigned"`
+	BatchSize      *int      `json:"batchSize"`
+	BatchInterval  *Duration `json:"batchInterval"`
+	InstallChain   *bool     `json:"installChain"`
+	InstallCRL     *bool     `json:"installCRL"`
+	RenewBefore    *Duration `json:"renewBefore"`
+	Seed           *int64    `json:"seed"`
+	SkipVerify     *bool     `json:"skipVerify"`
+	StrictVerify   *bool     `json:"strictVerify"`
+	OutputFolder   string    `json:"outputFolder"`
+	CA             CAParams  `json:"ca"`
+
+	// exportCSR forces csr-only generation for every request, see runExportCsr
+	exportCSR bool
 }
 
+// initConfig parses the json config, // and /* */ comments and trailing commas are allowed, unknown fields are not.
 func initConfig(data []byte) (*Config, error) {
 	var config Config
-	err := json.Unmarshal(data, &config)
+	decoder := json.NewDecoder(bytes.NewReader(stripJSONC(data)))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
 	if err != nil {
 		return &config, err
 	}
@@ -72,15 +213,39 @@ func initConfig(data []byte) (*Config, error) {
 	if config.Params.SkipRoot == nil {
 		config.Params.SkipRoot = skipRootFlag
 	}
-	// if config.Params.InstallChain == nil {
-	// 	config.Params.InstallChain = installChainFlag
-	// }
+	if config.Params.InstallChain == nil {
+		config.Params.InstallChain = installChainFlag
+	}
+	if config.Params.InstallCRL == nil {
+		config.Params.InstallCRL = installCRLFlag
+	}
 	if config.Params.SkipStore == nil {
 		config.Params.SkipStore = skipStoreFlag
 	}
 	if config.Params.SkipCSRRequest == nil {
 		config.Params.SkipCSRRequest = skipCSRRequestFlag
 	}
+	if config.Params.SelfSigned == nil {
+		config.Params.SelfSigned = selfSignedFlag
+	}
+	if config.Params.BatchSize == nil {
+		config.Params.BatchSize = batchSizeFlag
+	}
+	if config.Params.BatchInterval == nil {
+		config.Params.BatchInterval = &Duration{*batchIntervalFlag}
+	}
+	if config.Params.SkipVerify == nil {
+		config.Params.SkipVerify = skipVerifyFlag
+	}
+	if config.Params.StrictVerify == nil {
+		config.Params.StrictVerify = strictVerifyFlag
+	}
+	if config.Params.RenewBefore == nil {
+		config.Params.RenewBefore = &Duration{*renewBeforeFlag}
+	}
+	if config.Params.Seed == nil {
+		config.Params.Seed = seedFlag
+	}
 	if config.Params.OutputFolder == "" {
 		config.Params.OutputFolder = *outputFolderFlag
 	}
@@ -88,12 +253,115 @@ func initConfig(data []byte) (*Config, error) {
 	if config.Params.CA.Url == nil {
 		config.Params.CA.Url = caUrlFlag
 	}
+	if config.Params.CA.Type == nil {
+		config.Params.CA.Type = caTypeFlag
+	}
+	if config.Params.CA.PendingTimeout == nil {
+		config.Params.CA.PendingTimeout = &Duration{*pendingTimeoutFlag}
+	}
+	if config.Params.CA.PendingInterval == nil {
+		config.Params.CA.PendingInterval = &Duration{*pendingIntervalFlag}
+	}
+	if config.Params.CA.Timeout == nil {
+		config.Params.CA.Timeout = &Duration{*caTimeoutFlag}
+	}
+	if config.Params.CA.RateLimit == nil {
+		config.Params.CA.RateLimit = rateLimitFlag
+	}
+	if config.Params.CA.Retry.Attempts == nil {
+		config.Params.CA.Retry.Attempts = retryAttemptsFlag
+	}
+	if config.Params.CA.Retry.Backoff == nil {
+		config.Params.CA.Retry.Backoff = &Duration{*retryBackoffFlag}
+	}
+	if config.Params.CA.Retry.MaxBackoff == nil {
+		config.Params.CA.Retry.MaxBackoff = &Duration{time.Minute}
+	}
+	if config.Params.CA.Local.Folder == "" {
+		config.Params.CA.Local.Folder = filepath.Join(config.Params.OutputFolder, "local_ca")
+	}
 	return &config, nil
 }
 
+// loadCommandConfig loads the config of commands working with an existing output folder.
+// Only a missing file falls back to the default params, any other config error stops the command.
+func loadCommandConfig(path string) (*Config, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		slog.Debug(fmt.Sprintf("File: '%s' not exists, using default params", path))
+		return initConfig([]byte("{}"))
+	}
+	return loadConfig(path)
+}
+
+func loadConfig(path string) (*Config, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("File: '%s' not exists", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := configFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonData, err := configToJSON(path, format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := initConfig(jsonData)
+	if err != nil {
+		return nil, newConfigError(path, format, data, err)
+	}
+
+	err = loadSources(config)
+	if err != nil {
+		return nil, &ConfigError{File: path, Message: err.Error()}
+	}
+
+	err = resolveRequests(config)
+	if err != nil {
+		return nil, &ConfigError{File: path, Message: err.Error()}
+	}
+	return config, nil
+}
+
+func saveContainersInfo(path string, containersInfo []ContainerInfo) error {
+	infoData, err := json.MarshalIndent(containersInfo, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	infoFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer infoFile.Close()
+
+	_, err = infoFile.Write(infoData)
+	return err
+}
+
 func main() {
 	flag.Usage = defaultHelpUsage
-	flag.Parse()
+
+	command := ""
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	if *versionFlag {
 		fmt.Println("Masscsr version 0.4.1")
@@ -123,28 +391,49 @@ func main() {
 	logger := slog.New(handler)
 	slog.SetDefault(logger)
 
-	if _, err := os.Stat(*csrFileFlag); errors.Is(err, os.ErrNotExist) {
-		slog.Error(fmt.Sprintf("File: '%s' not exists", *csrFileFlag))
-		return
+	switch command {
+	case "":
+		runGenerate()
+	case "resume":
+		runResume()
+	case "renew":
+		runRenew()
+	case "export-csr":
+		runExportCsr()
+	case "import-certs":
+		runImportCerts()
+	case "mock-ca":
+		runMockCA()
+	case "validate":
+		if !runValidate() {
+			// Log file is not buffered, nothing is lost by skipping the deferred close
+			os.Exit(1)
+		}
+	default:
+		slog.Error(fmt.Sprintf("Unknown command: %s", command))
+		flag.Usage()
 	}
+}
 
-	file, err := os.Open(*csrFileFlag)
+func runGenerate() {
+	config, err := loadConfig(*csrFileFlag)
 	if err != nil {
 		slog.Error(err.Error())
 		return
 	}
-	defer file.Close()
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		slog.Error(err.Error())
-		return
-	}
+	generate(config)
+}
 
-	config, err := initConfig(data)
+// generate creates containers for all requests of the config and writes info.json.
+func generate(config *Config) []ContainerInfo {
+	err := expandRequests(config)
 	if err != nil {
-		slog.Error(err.Error())
-		return
+		slog.Error(fmt.Sprintf("Cant expand requests, error: %s", err.Error()))
+		return nil
+	}
+	if !checkConfig(config) {
+		return nil
 	}
 
 	if config.Params.OutputFolder == "" {
@@ -160,45 +449,56 @@ func main() {
 	cadesLocal, err := cades.NewCades()
 	if err != nil {
 		slog.Error(err.Error())
-		return
+		return nil
 	}
 	defer cadesLocal.Close()
 
-	if !*config.Params.SkipRoot {
-		InstallRoot(cadesLocal, &config.Params)
-	}
-
-	// if *config.Params.InstallChain {
-	// 	InstallChain(cadesLocal, &config.Params)
-	// }
-
+	pool := newCAPool(cadesLocal, &config.Params, true)
 	x509 := cades.CreateX509EnrollmentRoot(cadesLocal)
 
 	var containersInfo []ContainerInfo
-	for _, csr := range config.Requests {
-		info := ExecuteCsrInstall(x509, &csr, &config.Params)
+	batchSize := *config.Params.BatchSize
+	for index, csr := range config.Requests {
+		if batchSize > 0 && index > 0 && index%batchSize == 0 {
+			slog.Info(fmt.Sprintf("Batch of %d requests done, next batch in %s", batchSize, config.Params.BatchInterval.Duration))
+			time.Sleep(config.Params.BatchInterval.Duration)
+		}
 
-		if (info != &ContainerInfo{}) {
-			containersInfo = append(containersInfo, *info)
+		params, err := pool.Params(&csr)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant resolve params, container[%s], error: %s", csr.Container.Name, err.Error()))
+			continue
 		}
-	}
 
-	infoData, err := json.MarshalIndent(containersInfo, "", "\t")
-	if err == nil {
-		var infoPath string
-		if config.Params.OutputFolder == "" {
-			infoPath = filepath.Join(*outputFolderFlag, "info.json")
-		} else {
-			infoPath = filepath.Join(config.Params.OutputFolder, "info.json")
+		// CAs are created on first use, so their roots, chains and local CA keys only appear when a request needs them
+		var requestCA CA
+		if needsCA(&csr, params) {
+			requestCA, err = pool.get(params)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Cant create CA, container[%s], error: %s", csr.Container.Name, err.Error()))
+				continue
+			}
 		}
 
-		infoFile, err := os.Create(infoPath)
-		if err != nil {
-			slog.Error(err.Error())
-			return
+		info := ExecuteCsrInstall(x509, requestCA, &csr, params)
+
+		if (info != &ContainerInfo{}) {
+			containersInfo = append(containersInfo, *info)
 		}
-		defer infoFile.Close()
+	}
 
-		infoFile.Write(infoData)
+	infoPath := filepath.Join(config.Params.OutputFolder, "info.json")
+	err = saveContainersInfo(infoPath, containersInfo)
+	if err != nil {
+		slog.Error(err.Error())
 	}
+
+	var crls []CRLInfo
+	if *config.Params.InstallCRL {
+		crls = InstallCRLs(pool, containersInfo)
+	}
+
+	logReport(containersInfo)
+	logCRLReport(crls)
+	return containersInfo
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	MockModeIssue     = "issue"
+	MockModePending   = "pending"
+	MockModeDenied    = "denied"
+	MockModeMalformed = "malformed"
+
+	// MockModeAttribute overrides the server mode for a single request, e.g. certAttributes: {"MockMode": "denied"}.
+	MockModeAttribute = "MockMode"
+)
+
+const (
+	MOCK_ISSUED_PAGE = `<html><head><title>Certificate Issued</title></head><body>
+<p>The certificate you requested was issued to you.</p>
+<a href="certnew.cer?ReqID=%d&amp;Enc=b64">Download certificate</a>
+</body></html>`
+	MOCK_PENDING_PAGE = `<html><head><title>Certificate Pending</title></head><body>
+<p>Your certificate request has been received. However, you must wait for an administrator to issue the certificate you requested.</p>
+<p>Your Request Id is %d.</p>
+</body></html>`
+	MOCK_DENIED_PAGE = `<html><head><title>Certificate Request Denied</title></head><body>
+<p>Your certificate request was denied.</p>
+<p>Your Request Id is %d. The disposition message is "Denied by Policy Module 0x80094012, The permissions on the certificate template do not allow the current user to enroll for this type of certificate.".</p>
+</body></html>`
+	MOCK_ERROR_PAGE = `<html><head><title>Error</title></head><body>
+<p>An unexpected error has occurred: %s 0x80070057</p>
+</body></html>`
+	MOCK_MALFORMED_CERTIFICATE = "-----BEGIN CERTIFICATE-----\r\nTUFMRk9STUVEIENFUlRJRklDQVRF\r\n-----END CERTIFICATE-----\r\n"
+)
+
+type mockRequest struct {
+	mode        string
+	certificate string
+	readyAt     time.Time
+}
+
+// mockIssuer is the part of LocalCA used by MockCA.
+type mockIssuer interface {
+	issue(request *x509.CertificateRequest) ([]byte, error)
+	Root() (string, error)
+	Chain() (string, error)
+}
+
+// MockCA serves the certsrv pages used by CertsrvCA and issues certificates with LocalCA.
+// Pending requests are issued after pendingDelay, so resume and -pending-timeout can be checked.
+type MockCA struct {
+	mu           sync.Mutex
+	ca           mockIssuer
+	mode         string
+	pendingDelay time.Duration
+	requests     map[int]*mockRequest
+	lastId       int
+}
+
+func NewMockCA(ca mockIssuer, mode string, pendingDelay time.Duration) (*MockCA, error) {
+	if !isMockMode(mode) {
+		return nil, fmt.Errorf("unknown mock mode: %s", mode)
+	}
+
+	return &MockCA{
+		ca:           ca,
+		mode:         mode,
+		pendingDelay: pendingDelay,
+		requests:     map[int]*mockRequest{},
+	}, nil
+}
+
+func isMockMode(mode string) bool {
+	switch mode {
+	case MockModeIssue, MockModePending, MockModeDenied, MockModeMalformed:
+		return true
+	}
+	return false
+}
+
+func (m *MockCA) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/certsrv/certfnsh.asp", m.handleSubmit)
+	mux.HandleFunc("/certsrv/certnew.cer", m.handleCertificate)
+	mux.HandleFunc("/certsrv/certnew.p7b", m.handleChain)
+	return mux
+}
+
+func (m *MockCA) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode := m.mode
+	for _, attribute := range strings.Split(r.PostForm.Get("CertAttrib"), "\n") {
+		name, value, found := strings.Cut(strings.TrimSpace(attribute), ":")
+		if found && strings.EqualFold(name, MockModeAttribute) && isMockMode(value) {
+			mode = value
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastId++
+	requestId := m.lastId
+	request := &mockRequest{mode: mode, readyAt: time.Now()}
+
+	if mode != MockModeDenied {
+		certificate, err := m.issue(r.PostForm.Get("CertRequest"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant issue certificate, request[%d], error: %s", requestId, err.Error()))
+			writeMockPage(w, MOCK_ERROR_PAGE, err.Error())
+			return
+		}
+		request.certificate = certificate
+	}
+	if mode == MockModePending {
+		request.readyAt = request.readyAt.Add(m.pendingDelay)
+	}
+	m.requests[requestId] = request
+
+	slog.Info(fmt.Sprintf("Request[%d] submitted, mode: %s", requestId, mode))
+	switch mode {
+	case MockModePending:
+		writeMockPage(w, MOCK_PENDING_PAGE, requestId)
+	case MockModeDenied:
+		writeMockPage(w, MOCK_DENIED_PAGE, requestId)
+	default:
+		writeMockPage(w, MOCK_ISSUED_PAGE, requestId)
+	}
+}
+
+func (m *MockCA) issue(csr string) (string, error) {
+	csrDer, err := csrToDer(csr)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := m.ca.issue(request)
+	if err != nil {
+		return "", err
+	}
+	return derToPem(der), nil
+}
+
+func (m *MockCA) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	requestIdValue := r.URL.Query().Get("ReqID")
+	if requestIdValue == "CACert" {
+		root, _ := m.ca.Root()
+		writeMockCertificate(w, root)
+		return
+	}
+
+	requestId, err := strconv.Atoi(requestIdValue)
+	if err != nil {
+		writeMockPage(w, MOCK_ERROR_PAGE, fmt.Sprintf("invalid request id %q", requestIdValue))
+		return
+	}
+
+	m.mu.Lock()
+	request, ok := m.requests[requestId]
+	m.mu.Unlock()
+
+	switch {
+	case !ok:
+		writeMockPage(w, MOCK_ERROR_PAGE, fmt.Sprintf("request %d not found", requestId))
+	case request.mode == MockModeDenied:
+		writeMockPage(w, MOCK_DENIED_PAGE, requestId)
+	case time.Now().Before(request.readyAt):
+		writeMockPage(w, MOCK_PENDING_PAGE, requestId)
+	case request.mode == MockModeMalformed:
+		writeMockCertificate(w, MOCK_MALFORMED_CERTIFICATE)
+	default:
+		writeMockCertificate(w, request.certificate)
+	}
+}
+
+func (m *MockCA) handleChain(w http.ResponseWriter, r *http.Request) {
+	chain, err := m.ca.Chain()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeMockCertificate(w, chain)
+}
+
+func writeMockPage(w http.ResponseWriter, page string, args ...any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, page, args...)
+}
+
+func writeMockCertificate(w http.ResponseWriter, data string) {
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	fmt.Fprint(w, data)
+}
+
+// runMockCA starts a certsrv compatible server on -listen, the CA key is taken from ca.local of the config.
+func runMockCA() {
+	config, err := loadCommandConfig(*csrFileFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	cadesLocal, err := cades.NewCades()
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	defer cadesLocal.Close()
+
+	localCA, err := NewLocalCA(cadesLocal, &config.Params.CA)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create local CA, error: %s", err.Error()))
+		return
+	}
+
+	mock, err := NewMockCA(localCA, *mockModeFlag, *mockPendingDelayFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	slog.Info(fmt.Sprintf("Mock CA listening on http://%s, mode: %s", *listenFlag, *mockModeFlag))
+	err = http.ListenAndServe(*listenFlag, mock.Handler())
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testIssuer stands in for LocalCA, certificates are signed with an ECDSA key instead of the CSP.
+type testIssuer struct {
+	key         *ecdsa.PrivateKey
+	certificate *x509.Certificate
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Mock CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{key: key, certificate: certificate}
+}
+
+func (ca *testIssuer) issue(request *x509.CertificateRequest) ([]byte, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      request.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	return x509.CreateCertificate(rand.Reader, template, ca.certificate, request.PublicKey, ca.key)
+}
+
+func (ca *testIssuer) Root() (string, error)  { return derToPem(ca.certificate.Raw), nil }
+func (ca *testIssuer) Chain() (string, error) { return derToPem(ca.certificate.Raw), nil }
+
+func testCsr(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "TEST"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestMockCA(t *testing.T) {
+	issuer := newTestIssuer(t)
+	csr := testCsr(t)
+
+	tests := []struct {
+		name       string
+		mode       string
+		attributes []string
+		submit     CAStatus
+		status     CAStatus
+		malformed  bool
+	}{
+		{name: "issue", mode: MockModeIssue, submit: CAStatusIssued, status: CAStatusIssued},
+		{name: "pending", mode: MockModePending, submit: CAStatusPending, status: CAStatusIssued},
+		{name: "denied", mode: MockModeDenied, submit: CAStatusDenied},
+		{name: "malformed", mode: MockModeMalformed, submit: CAStatusIssued, status: CAStatusIssued, malformed: true},
+		{
+			name:       "mode attribute",
+			mode:       MockModeIssue,
+			attributes: []string{"CertificateTemplate:User", MockModeAttribute + ":" + MockModeDenied},
+			submit:     CAStatusDenied,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pendingDelay := 100 * time.Millisecond
+			mock, err := NewMockCA(issuer, test.mode, pendingDelay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := httptest.NewServer(mock.Handler())
+			defer server.Close()
+
+			ca, err := NewCertsrvCA(&CAParams{Url: &server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			request, err := ca.SubmitWithAttributes(csr, test.attributes)
+			if test.submit == CAStatusDenied {
+				var caErr *CAError
+				if !errors.As(err, &caErr) || caErr.Status != CAStatusDenied || caErr.RequestId != "1" {
+					t.Fatalf("SubmitWithAttributes() error = %v, expected denied request 1", err)
+				}
+				if _, err = ca.Certificate("1"); !errors.As(err, &caErr) || caErr.Status != CAStatusDenied {
+					t.Fatalf("Certificate() error = %v, expected denied", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SubmitWithAttributes() error = %v", err)
+			}
+			if request.Id != "1" || request.Status != test.submit {
+				t.Fatalf("SubmitWithAttributes() = %s %s, expected 1 %s", request.Id, request.Status, test.submit)
+			}
+
+			if test.submit == CAStatusPending {
+				if status, err := ca.Status(request.Id); err != nil || status != CAStatusPending {
+					t.Fatalf("Status() = %s, %v, expected pending before the delay", status, err)
+				}
+				time.Sleep(pendingDelay)
+			}
+			if status, err := ca.Status(request.Id); err != nil || status != test.status {
+				t.Fatalf("Status() = %s, %v, expected %s", status, err, test.status)
+			}
+
+			certificate, err := ca.Certificate(request.Id)
+			if err != nil {
+				t.Fatalf("Certificate() error = %v", err)
+			}
+			block, _ := pem.Decode([]byte(certificate))
+			if block == nil {
+				t.Fatalf("Certificate() = %q, expected PEM", certificate)
+			}
+			_, err = x509.ParseCertificate(block.Bytes)
+			if (err != nil) != test.malformed {
+				t.Fatalf("ParseCertificate() error = %v, expected error: %t", err, test.malformed)
+			}
+
+			if _, err = ca.Certificate("2"); err == nil {
+				t.Fatal("Certificate() of an unknown request returned no error")
+			}
+			if root, err := ca.Root(); err != nil || root != derToPem(issuer.certificate.Raw) {
+				t.Fatalf("Root() = %q, %v", root, err)
+			}
+		})
+	}
+}
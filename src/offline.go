@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	"golang.org/x/exp/slog"
+)
+
+const MANIFEST_FILE = "manifest.json"
+
+// ManifestEntry links an exported csr with its container, PublicKeyHash is used to find the issued certificate.
+type ManifestEntry struct {
+	Name          string `json:"name"`
+	ContainerName string `json:"containerName,omitempty"`
+	Csr           string `json:"csr"`
+	PublicKeyHash string `json:"publicKeyHash"`
+}
+
+// publicKeyHash returns sha256 of the subjectPublicKey bits, the same for the csr and the issued certificate.
+func publicKeyHash(spki []byte) (string, error) {
+	var info subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(spki, &info); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(info.PublicKey.Bytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// runExportCsr generates containers and csr files without sending them to the CA
+// and writes manifest.json for import-certs.
+func runExportCsr() {
+	config, err := loadConfig(*csrFileFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	skipRoot, disabled := true, false
+	config.Params.SkipRoot = &skipRoot
+	config.Params.SelfSigned = &disabled
+	config.Params.InstallChain = &disabled
+	config.Params.InstallCRL = &disabled
+	config.Params.exportCSR = true
+
+	containersInfo := generate(config)
+
+	var manifest []ManifestEntry
+	for _, info := range containersInfo {
+		if info.Name == "" || info.Effective == nil {
+			continue
+		}
+
+		params, err := requestParams(&config.Params, info.Request)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+
+		csrFilePath := filepath.Join(containerOutputFolder(params, info.Name), fmt.Sprintf("%s.csr", info.Name))
+		csrData, err := os.ReadFile(csrFilePath)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant read csr: %s, error: %s", csrFilePath, err.Error()))
+			continue
+		}
+
+		csrDer, err := csrToDer(string(csrData))
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant decode csr: %s, error: %s", csrFilePath, err.Error()))
+			continue
+		}
+		request, err := x509.ParseCertificateRequest(csrDer)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant parse csr: %s, error: %s", csrFilePath, err.Error()))
+			continue
+		}
+
+		hash, err := publicKeyHash(request.RawSubjectPublicKeyInfo)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant hash public key: %s, error: %s", csrFilePath, err.Error()))
+			continue
+		}
+
+		relativePath, err := filepath.Rel(config.Params.OutputFolder, csrFilePath)
+		if err != nil {
+			relativePath = csrFilePath
+		}
+
+		manifest = append(manifest, ManifestEntry{
+			Name:          info.Name,
+			ContainerName: info.ContainerName,
+			Csr:           filepath.ToSlash(relativePath),
+			PublicKeyHash: hash,
+		})
+	}
+
+	manifestPath := filepath.Join(config.Params.OutputFolder, MANIFEST_FILE)
+	manifestData, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	err = os.WriteFile(manifestPath, manifestData, 0644)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", manifestPath, err.Error()))
+		return
+	}
+	slog.Info(fmt.Sprintf("Exported %d csr requests, manifest: %s", len(manifest), manifestPath))
+}
+
+// runImportCerts installs certificates issued for exported csr requests, certificates are matched
+// with containers by the public key hash from manifest.json.
+func runImportCerts() {
+	config, err := loadCommandConfig(*csrFileFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	manifestPath := filepath.Join(config.Params.OutputFolder, MANIFEST_FILE)
+	manifestData, err := os.ReadFile(manifestPath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant read file: %s, error: %s", manifestPath, err.Error()))
+		return
+	}
+
+	var manifest []ManifestEntry
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant parse file: %s, error: %s", manifestPath, err.Error()))
+		return
+	}
+
+	entries := map[string]ManifestEntry{}
+	for _, entry := range manifest {
+		entries[entry.PublicKeyHash] = entry
+	}
+
+	infoPath := filepath.Join(config.Params.OutputFolder, "info.json")
+	containersInfo, err := loadContainersInfo(infoPath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant read file: %s, error: %s", infoPath, err.Error()))
+		return
+	}
+
+	certificates, err := loadIssuedCertificates(*certsFolderFlag)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant read certificates from: %s, error: %s", *certsFolderFlag, err.Error()))
+		return
+	}
+
+	cadesLocal, err := cades.NewCades()
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	defer cadesLocal.Close()
+
+	pool := newCAPool(cadesLocal, &config.Params, false)
+	x509Root := cades.CreateX509EnrollmentRoot(cadesLocal)
+
+	imported := 0
+	for _, certificate := range certificates {
+		hash, err := publicKeyHash(certificate.RawSubjectPublicKeyInfo)
+		if err != nil {
+			continue
+		}
+
+		entry, ok := entries[hash]
+		if !ok {
+			slog.Debug(fmt.Sprintf("No container for certificate[%s]", certificate.Subject.String()))
+			continue
+		}
+
+		var info *ContainerInfo
+		for index := range containersInfo {
+			if containersInfo[index].Name == entry.Name {
+				info = &containersInfo[index]
+				break
+			}
+		}
+		if info == nil {
+			slog.Error(fmt.Sprintf("Container[%s] not found in %s", entry.Name, infoPath))
+			continue
+		}
+
+		params, err := pool.Params(infoRequest(info))
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant resolve params, container[%s], error: %s", info.Name, err.Error()))
+			continue
+		}
+
+		err = ImportCertificate(x509Root, derToPem(certificate.Raw), entry, info, config.Params.OutputFolder, params)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant import certificate, container[%s], error: %s", info.Name, err.Error()))
+			continue
+		}
+		delete(entries, hash)
+		imported++
+	}
+
+	for _, entry := range entries {
+		slog.Warn(fmt.Sprintf("Certificate for container[%s] not found in %s", entry.Name, *certsFolderFlag))
+	}
+
+	err = saveContainersInfo(infoPath, containersInfo)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+
+	slog.Info(fmt.Sprintf("Imported %d certificates", imported))
+	logReport(containersInfo)
+}
+
+// ImportCertificate checks the certificate against the exported csr and installs it into the container.
+func ImportCertificate(x509Root *cades.X509EnrollmentRoot, certificate string, entry ManifestEntry, info *ContainerInfo, manifestFolder string, params *Params) error {
+	cm := cades.CadesManager{}
+
+	csrData, err := os.ReadFile(filepath.Join(manifestFolder, filepath.FromSlash(entry.Csr)))
+	if err != nil {
+		return err
+	}
+
+	err = checkIssuedCertificate(certificate, string(csrData), info, params)
+	if err != nil {
+		return err
+	}
+
+	container, err := cm.GetContainer(info.Name)
+	if err != nil {
+		return err
+	}
+
+	err = installIssuedCertificate(x509Root, certificate, container, info, containerOutputFolder(params, info.Name), params)
+	if err != nil {
+		return err
+	}
+
+	info.Status = CAStatusIssued
+	info.ContainerName = container.ContainerName
+	if *params.SkipStore {
+		info.ContainerName = ""
+	}
+	slog.Info(fmt.Sprintf("Certificate for container[%s] imported", info.Name))
+	return nil
+}
+
+// loadIssuedCertificates reads .cer, .crt, .pem and .p7b files of the folder, p7b bundles may hold several certificates.
+func loadIssuedCertificates(folder string) ([]*x509.Certificate, error) {
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []*x509.Certificate
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(folder, file.Name())
+		extension := strings.ToLower(filepath.Ext(file.Name()))
+		if extension != ".cer" && extension != ".crt" && extension != ".pem" && extension != ".p7b" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant read file: %s, error: %s", path, err.Error()))
+			continue
+		}
+
+		if extension == ".p7b" {
+			bundle, err := parsePkcs7Certificates(data)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Cant parse file: %s, error: %s", path, err.Error()))
+				continue
+			}
+			certificates = append(certificates, bundle...)
+			continue
+		}
+
+		certificate, err := parseCertificate(data)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant parse file: %s, error: %s", path, err.Error()))
+			continue
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	"golang.org/x/exp/slog"
+)
+
+var CA_NAME_PATTERN = regexp.MustCompile(`[^\w.-]+`)
+
+// RequestParams are the run parameters applied to a request after per-request overrides.
+type RequestParams struct {
+	CAType         string `json:"caType"`
+	CAUrl          string `json:"caUrl"`
+	SkipStore      bool   `json:"skipStore"`
+	SkipCSRRequest bool   `json:"skipCSRRequest"`
+	Flat           bool   `json:"flat"`
+	OutputFolder   string `json:"outputFolder"`
+}
+
+func newRequestParams(params *Params) *RequestParams {
+	return &RequestParams{
+		CAType:         *params.CA.Type,
+		CAUrl:          *params.CA.Url,
+		SkipStore:      *params.SkipStore,
+		SkipCSRRequest: *params.SkipCSRRequest,
+		Flat:           *params.Flat,
+		OutputFolder:   params.OutputFolder,
+	}
+}
+
+// requestParams returns global params with the overrides of the request applied.
+// Pointer fields of the result are replaced, never written through, so global params stay intact.
+func requestParams(global *Params, csr *CsrParams) (*Params, error) {
+	params := *global
+	if csr.Flat != nil {
+		params.Flat = csr.Flat
+	}
+	if csr.SkipStore != nil {
+		params.SkipStore = csr.SkipStore
+	}
+	if csr.SkipCSRRequest != nil {
+		params.SkipCSRRequest = csr.SkipCSRRequest
+	}
+	if csr.OutputFolder != "" {
+		params.OutputFolder = csr.OutputFolder
+	}
+
+	if params.exportCSR {
+		skipCSRRequest := true
+		params.SkipCSRRequest = &skipCSRRequest
+	}
+
+	if len(csr.CA) > 0 {
+		caParams, err := mergeCAParams(&global.CA, csr.CA)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ca params of request[%s]: %s", csr.Container.Name, err.Error())
+		}
+		params.CA = *caParams
+	}
+	return &params, nil
+}
+
+// mergeCAParams decodes override on top of a deep copy of global, fields missing in override keep the global values.
+// Unknown fields in override are an error, as in the config itself.
+// A CA without a name gets one from its type and host, so its root and chain files do not clash with the global CA.
+func mergeCAParams(global *CAParams, override json.RawMessage) (*CAParams, error) {
+	data, err := json.Marshal(global)
+	if err != nil {
+		return nil, err
+	}
+
+	var params CAParams
+	err = json.Unmarshal(data, &params)
+	if err != nil {
+		return nil, err
+	}
+	params.Name = ""
+
+	decoder := json.NewDecoder(bytes.NewReader(override))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Type == nil {
+		params.Type = global.Type
+	}
+	if params.Url == nil {
+		params.Url = global.Url
+	}
+
+	if params.Name == "" {
+		host := *params.Url
+		if uri, err := url.Parse(caBaseURL(&params)); err == nil {
+			host = uri.Host
+		}
+		params.Name = CA_NAME_PATTERN.ReplaceAllString(fmt.Sprintf("%s_%s", *params.Type, host), "_")
+	}
+	return &params, nil
+}
+
+// caPool creates CA backends on first use and installs their root and chain once per CA.
+// Commands working with an existing info.json do not install roots again.
+type caPool struct {
+	cades       *cades.Cades
+	global      *Params
+	installRoot bool
+	cas         map[string]CA
+	// used keeps the created CAs in creation order with the params they were created for
+	used []usedCA
+}
+
+type usedCA struct {
+	ca     CA
+	params *Params
+}
+
+func newCAPool(cadesObj *cades.Cades, global *Params, installRoot bool) *caPool {
+	return &caPool{
+		cades:       cadesObj,
+		global:      global,
+		installRoot: installRoot,
+		cas:         map[string]CA{},
+	}
+}
+
+// Params returns the effective params of the request without creating its CA.
+func (p *caPool) Params(csr *CsrParams) (*Params, error) {
+	params, err := requestParams(p.global, csr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(params.OutputFolder, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// Resolve returns the CA and the effective params of the request.
+func (p *caPool) Resolve(csr *CsrParams) (CA, *Params, error) {
+	params, err := p.Params(csr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := p.get(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, params, nil
+}
+
+// ResolveInfo returns the CA and the effective params of a request recorded in info.json.
+func (p *caPool) ResolveInfo(info *ContainerInfo) (CA, *Params, error) {
+	return p.Resolve(infoRequest(info))
+}
+
+// infoRequest returns the saved request of an info.json entry, entries without one use the global params.
+func infoRequest(info *ContainerInfo) *CsrParams {
+	if info.Request == nil {
+		return &CsrParams{}
+	}
+	return info.Request
+}
+
+// needsCA reports whether the request is sent to a CA, saved only and self-signed requests are not.
+func needsCA(csr *CsrParams, params *Params) bool {
+	if *params.SkipCSRRequest {
+		return false
+	}
+	if csr.CsrFile != "" {
+		return true
+	}
+
+	selfSigned := *params.SelfSigned
+	if csr.SelfSigned != nil && !params.exportCSR {
+		selfSigned = *csr.SelfSigned
+	}
+	return !selfSigned
+}
+
+func (p *caPool) get(params *Params) (CA, error) {
+	key, err := json.Marshal(params.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	if ca, ok := p.cas[string(key)]; ok {
+		return ca, nil
+	}
+
+	ca, err := NewCA(p.cades, &params.CA)
+	if err != nil {
+		return nil, err
+	}
+	p.cas[string(key)] = ca
+	p.used = append(p.used, usedCA{ca: ca, params: params})
+
+	if params.CA.Name != "" {
+		slog.Info(fmt.Sprintf("Using CA[%s] %s", params.CA.Name, strings.TrimSpace(*params.CA.Url)))
+	}
+
+	if !p.installRoot {
+		return ca, nil
+	}
+
+	if !*params.SkipRoot && !*params.SelfSigned {
+		InstallRoot(p.cades, ca, params)
+	}
+
+	if *params.InstallChain && !*params.SelfSigned {
+		InstallChain(p.cades, ca, params)
+	}
+	return ca, nil
+}
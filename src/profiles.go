@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+const RESOLVED_REQUEST_SUFFIX = ".request.json"
+
+// resolveRequests applies config.Defaults and the profiles named in extends to every request.
+// Profiles may extend other profiles, the request itself is applied last.
+func resolveRequests(config *Config) error {
+	resolved := map[string]*CsrParams{}
+	// defaults are the base of the root profile, so an empty dn value in a profile also removes a default attribute
+	defaults := &CsrParams{}
+	if config.Defaults != nil {
+		defaults = config.Defaults
+	}
+
+	var resolveProfile func(name string, chain []string) (*CsrParams, error)
+	resolveProfile = func(name string, chain []string) (*CsrParams, error) {
+		if profile, ok := resolved[name]; ok {
+			return profile, nil
+		}
+		for _, item := range chain {
+			if item == name {
+				return nil, fmt.Errorf("profile cycle: %s -> %s", strings.Join(chain, " -> "), name)
+			}
+		}
+
+		profile, ok := config.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		if profile.Count != 0 {
+			return nil, fmt.Errorf("profile %q: count is allowed only in requests", name)
+		}
+
+		base := defaults
+		if profile.Extends != "" {
+			parent, err := resolveProfile(profile.Extends, append(chain, name))
+			if err != nil {
+				return nil, err
+			}
+			base = parent
+		}
+
+		result := mergeCsrParams(base, &profile)
+		resolved[name] = &result
+		return &result, nil
+	}
+
+	if config.Defaults != nil && config.Defaults.Count != 0 {
+		return fmt.Errorf("defaults: count is allowed only in requests")
+	}
+
+	for index := range config.Requests {
+		csr := &config.Requests[index]
+		if config.Defaults == nil && csr.Extends == "" {
+			continue
+		}
+
+		base := defaults
+		if csr.Extends != "" {
+			profile, err := resolveProfile(csr.Extends, nil)
+			if err != nil {
+				return fmt.Errorf("requests[%d]: %s", index, err.Error())
+			}
+			base = profile
+		}
+
+		*csr = mergeCsrParams(base, csr)
+	}
+	return nil
+}
+
+// mergeCsrParams returns base with the fields set in override. dn, san and certAttributes are merged by key,
+// an empty dn value removes the inherited attribute, extensionEKU of override replaces the inherited list.
+// Count is never inherited, it is taken from override only.
+func mergeCsrParams(base *CsrParams, override *CsrParams) CsrParams {
+	result := *base
+	result.Count = override.Count
+
+	if override.CA != nil {
+		result.CA = override.CA
+	}
+	if override.Flat != nil {
+		result.Flat = override.Flat
+	}
+	if override.SkipStore != nil {
+		result.SkipStore = override.SkipStore
+	}
+	if override.SkipCSRRequest != nil {
+		result.SkipCSRRequest = override.SkipCSRRequest
+	}
+	if override.OutputFolder != "" {
+		result.OutputFolder = override.OutputFolder
+	}
+	if override.Extends != "" {
+		result.Extends = override.Extends
+	}
+	if override.CsrFile != "" {
+		result.CsrFile = override.CsrFile
+	}
+	if override.SelfSigned != nil {
+		result.SelfSigned = override.SelfSigned
+	}
+	if override.ChallengePassword != "" {
+		result.ChallengePassword = override.ChallengePassword
+	}
+	if override.Template != "" {
+		result.Template = override.Template
+	}
+	if override.EKUKeyUsageFlags != nil {
+		result.EKUKeyUsageFlags = override.EKUKeyUsageFlags
+	}
+	if override.ProviderName != "" {
+		result.ProviderName = override.ProviderName
+	}
+
+	result.CertAttributes = mergeStringMap(base.CertAttributes, override.CertAttributes, false)
+	result.Dn = mergeStringMap(base.Dn, override.Dn, true)
+
+	// extensionEKU set in override replaces the inherited list, an empty list removes it
+	extensionEKU := base.ExtensionEKU
+	if override.ExtensionEKU != nil {
+		extensionEKU = override.ExtensionEKU
+	}
+	result.ExtensionEKU = nil
+	for _, oid := range extensionEKU {
+		if !containsString(result.ExtensionEKU, oid) {
+			result.ExtensionEKU = append(result.ExtensionEKU, oid)
+		}
+	}
+	if extensionEKU != nil && result.ExtensionEKU == nil {
+		result.ExtensionEKU = []string{}
+	}
+
+	if base.SAN != nil || override.SAN != nil {
+		result.SAN = map[string][]string{}
+		for oid, values := range base.SAN {
+			result.SAN[oid] = append([]string{}, values...)
+		}
+		for oid, values := range override.SAN {
+			result.SAN[oid] = append([]string{}, values...)
+		}
+	}
+
+	if override.Container.Name != "" {
+		result.Container.Name = override.Container.Name
+	}
+	if override.Container.Exportable != nil {
+		result.Container.Exportable = override.Container.Exportable
+	}
+	if override.Container.KeySpec != nil {
+		result.Container.KeySpec = override.Container.KeySpec
+	}
+	if override.Container.KeyProtection != nil {
+		result.Container.KeyProtection = override.Container.KeyProtection
+	}
+	if override.Container.Pin != "" {
+		result.Container.Pin = override.Container.Pin
+	}
+	return result
+}
+
+func mergeStringMap(base map[string]string, override map[string]string, removeEmpty bool) map[string]string {
+	if base == nil && override == nil {
+		return nil
+	}
+
+	result := make(map[string]string, len(base)+len(override))
+	for key, value := range base {
+		result[key] = value
+	}
+	for key, value := range override {
+		if removeEmpty && value == "" {
+			delete(result, key)
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// saveResolvedRequest writes the request as it was generated, with defaults, profiles and
+// generated values like the container name, to <name>.request.json. The container pin and
+// the challenge password are left out.
+func saveResolvedRequest(csr *CsrParams, name string, outputFolder string) {
+	resolved := *csr
+	resolved.ChallengePassword = ""
+	resolved.Container.Pin = ""
+
+	data, err := json.MarshalIndent(&resolved, "", "\t")
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	requestFilePath := filepath.Join(outputFolder, name+RESOLVED_REQUEST_SUFFIX)
+	err = os.WriteFile(requestFilePath, data, 0644)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant create file: %s, error: %s", requestFilePath, err.Error()))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResolveRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+		err      string
+	}{
+		{
+			name: "defaults and profile chain",
+			config: `{
+				"defaults": {"dn": {"O": "Org", "OU": "IT"}},
+				"profiles": {
+					"base": {
+						"extensionEKU": ["1.3.6.1.5.5.7.3.2", "1.3.6.1.5.5.7.3.4"],
+						"san": {"2.5.29.17": ["base@ca.lan"], "1.2.3": ["kept"]},
+						"container": {"exportable": true, "keyProtection": 1, "keySpec": 2},
+						"dn": {"CN": "Base"}
+					},
+					"child": {"extends": "base", "extensionEKU": ["1.3.6.1.5.5.7.3.1", "1.3.6.1.5.5.7.3.1"], "dn": {"OU": ""}}
+				},
+				"requests": [{
+					"extends": "child",
+					"count": 2,
+					"san": {"2.5.29.17": ["user@ca.lan"]},
+					"container": {"name": "TEST", "exportable": false, "keyProtection": 0},
+					"dn": {}
+				}]
+			}`,
+			expected: `{
+				"extends": "child",
+				"count": 2,
+				"extensionEKU": ["1.3.6.1.5.5.7.3.1"],
+				"san": {"2.5.29.17": ["user@ca.lan"], "1.2.3": ["kept"]},
+				"container": {"name": "TEST", "exportable": false, "keyProtection": 0, "keySpec": 2},
+				"dn": {"O": "Org", "CN": "Base"}
+			}`,
+		},
+		{
+			name: "empty extensionEKU removes the inherited list",
+			config: `{
+				"profiles": {"base": {"extensionEKU": ["1.3.6.1.5.5.7.3.4"], "dn": {"CN": "Base"}}},
+				"requests": [{"extends": "base", "extensionEKU": [], "dn": {}}]
+			}`,
+			expected: `{"extends": "base", "extensionEKU": [], "dn": {"CN": "Base"}}`,
+		},
+		{
+			name: "request without defaults and extends is kept",
+			config: `{
+				"profiles": {"base": {"dn": {"CN": "Base"}}},
+				"requests": [{"count": 3, "dn": {"CN": "Test"}}]
+			}`,
+			expected: `{"count": 3, "dn": {"CN": "Test"}}`,
+		},
+		{
+			name: "cycle",
+			config: `{
+				"profiles": {"a": {"extends": "b", "dn": {}}, "b": {"extends": "a", "dn": {}}},
+				"requests": [{"extends": "a", "dn": {"CN": "Test"}}]
+			}`,
+			err: "requests[0]: profile cycle: a -> b -> a",
+		},
+		{
+			name: "self cycle",
+			config: `{
+				"profiles": {"a": {"extends": "a", "dn": {}}},
+				"requests": [{"extends": "a", "dn": {"CN": "Test"}}]
+			}`,
+			err: "requests[0]: profile cycle: a -> a",
+		},
+		{
+			name:   "unknown profile",
+			config: `{"requests": [{"extends": "missing", "dn": {"CN": "Test"}}]}`,
+			err:    `requests[0]: unknown profile "missing"`,
+		},
+		{
+			name: "count in profile",
+			config: `{
+				"profiles": {"base": {"count": 2, "dn": {}}},
+				"requests": [{"extends": "base", "dn": {"CN": "Test"}}]
+			}`,
+			err: `requests[0]: profile "base": count is allowed only in requests`,
+		},
+		{
+			name:   "count in defaults",
+			config: `{"defaults": {"count": 2, "dn": {}}, "requests": [{"dn": {"CN": "Test"}}]}`,
+			err:    "defaults: count is allowed only in requests",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := initConfig([]byte(test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = resolveRequests(config)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("resolveRequests() error = %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveRequests() error = %v", err)
+			}
+
+			var expected CsrParams
+			if err = json.Unmarshal([]byte(test.expected), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.Requests[0], expected) {
+				result, _ := json.Marshal(config.Requests[0])
+				t.Errorf("resolveRequests() = %s, expected %s", result, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	cp "github.com/otiai10/copy"
+	"golang.org/x/exp/slog"
+)
+
+// runRenew re-issues certificates from info.json that expire within params.RenewBefore,
+// using the request parameters saved with each entry.
+func runRenew() {
+	config, err := loadCommandConfig(*csrFileFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	infoPath := filepath.Join(config.Params.OutputFolder, "info.json")
+	containersInfo, err := loadContainersInfo(infoPath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant read file: %s, error: %s", infoPath, err.Error()))
+		return
+	}
+
+	cadesLocal, err := cades.NewCades()
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	defer cadesLocal.Close()
+
+	pool := newCAPool(cadesLocal, &config.Params, false)
+	x509 := cades.CreateX509EnrollmentRoot(cadesLocal)
+	deadline := time.Now().Add(config.Params.RenewBefore.Duration)
+
+	renewed := 0
+	for index := range containersInfo {
+		info := &containersInfo[index]
+		if info.Thumbprint == "" {
+			continue
+		}
+		if info.Request == nil {
+			slog.Warn(fmt.Sprintf("Container[%s] has no saved request parameters, skip renew", info.Name))
+			continue
+		}
+
+		ca, params, err := pool.ResolveInfo(info)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant resolve params, container[%s], error: %s", info.Name, err.Error()))
+			continue
+		}
+
+		certificatePath := filepath.Join(containerOutputFolder(params, info.Name), fmt.Sprintf("%s.cer", info.Name))
+		certificateData, err := os.ReadFile(certificatePath)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant read certificate: %s, error: %s", certificatePath, err.Error()))
+			continue
+		}
+
+		certificate, err := parseCertificate(certificateData)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant parse certificate: %s, error: %s", certificatePath, err.Error()))
+			continue
+		}
+
+		if certificate.NotAfter.After(deadline) {
+			slog.Debug(fmt.Sprintf("Container[%s] certificate is valid until %s, skip renew", info.Name, certificate.NotAfter.Local().Format(time.DateTime)))
+			continue
+		}
+
+		slog.Info(fmt.Sprintf("Container[%s] certificate expires %s, renew", info.Name, certificate.NotAfter.Local().Format(time.DateTime)))
+		result := RenewCsrInstall(x509, ca, info, certificateData, params)
+		if result != nil {
+			*info = *result
+			renewed++
+		}
+	}
+
+	err = saveContainersInfo(infoPath, containersInfo)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+
+	slog.Info(fmt.Sprintf("Renewed %d certificates", renewed))
+	logReport(containersInfo)
+}
+
+// RenewCsrInstall removes the old container and certificate from the store and issues new ones with the same request.
+// The copy of the old container and its certificate are moved to <name>.bak first, when the new certificate
+// cannot be issued the old container is restored from there. Backends that implement Reenroller
+// (EST /simplereenroll) get the request as a re-enrollment.
+func RenewCsrInstall(x509 *cades.X509EnrollmentRoot, ca CA, info *ContainerInfo, oldCertificate []byte, params *Params) *ContainerInfo {
+	cm := cades.CadesManager{}
+	ca = renewCA(ca)
+	if info.Request.CsrFile != "" {
+		// The same csr is submitted again, there is no container to replace
+		csr := *info.Request
+		result := SubmitCsrFile(ca, &csr, params)
+		if result.Thumbprint != "" || result.Status == CAStatusPending {
+			return result
+		}
+		slog.Error(fmt.Sprintf("Cant renew certificate, request[%s]", info.Name))
+		return nil
+	}
+
+	backupFolder, err := backupContainer(info, oldCertificate, params)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant backup old container[%s], skip renew, error: %s", info.Name, err.Error()))
+		return nil
+	}
+
+	container, err := cm.GetContainer(info.Name)
+	if err == nil {
+		_, err = cm.DeleteContainer(container)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant delete old container[%s], error: %s", info.Name, err.Error()))
+			os.RemoveAll(backupFolder)
+			return nil
+		}
+	} else {
+		slog.Debug(fmt.Sprintf("Cant get old container[%s], error: %s", info.Name, err.Error()))
+	}
+	cm.DeleteCertificate(info.Thumbprint)
+
+	csr := *info.Request
+	result := ExecuteCsrInstall(x509, ca, &csr, params)
+	if result.Thumbprint != "" || result.Status == CAStatusPending {
+		os.RemoveAll(backupFolder)
+		return result
+	}
+
+	slog.Error(fmt.Sprintf("Cant renew certificate, container[%s], restore old container", info.Name))
+	if container, err := cm.GetContainer(info.Name); err == nil {
+		cm.DeleteContainer(container)
+	}
+	if result.ContainerFolder != "" && result.ContainerFolder != info.ContainerFolder {
+		os.RemoveAll(filepath.Join(containerOutputFolder(params, info.Name), result.ContainerFolder))
+	}
+
+	err = restoreContainer(info, backupFolder, params)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant restore container[%s], its copy is kept in %s, error: %s", info.Name, backupFolder, err.Error()))
+		return nil
+	}
+	os.RemoveAll(backupFolder)
+	return nil
+}
+
+// backupContainer copies the saved container folder and the certificate to <outputFolder>/<name>.bak.
+// Renew is refused without a copy of the old key, or when a backup of an interrupted renew is left.
+func backupContainer(info *ContainerInfo, certificate []byte, params *Params) (string, error) {
+	if info.ContainerFolder == "" {
+		return "", errors.New("no copy of the container in the output folder")
+	}
+
+	containerFolderPath := filepath.Join(containerOutputFolder(params, info.Name), info.ContainerFolder)
+	if _, err := os.Stat(containerFolderPath); err != nil {
+		return "", err
+	}
+
+	backupFolder := filepath.Join(params.OutputFolder, info.Name+".bak")
+	if _, err := os.Stat(backupFolder); err == nil {
+		return "", fmt.Errorf("backup %s of an interrupted renew exists, restore or remove it first", backupFolder)
+	}
+
+	err := cp.Copy(containerFolderPath, filepath.Join(backupFolder, info.ContainerFolder))
+	if err != nil {
+		os.RemoveAll(backupFolder)
+		return "", err
+	}
+
+	certificatePath := filepath.Join(backupFolder, fmt.Sprintf("%s.cer", info.Name))
+	err = os.WriteFile(certificatePath, certificate, 0644)
+	if err != nil {
+		os.RemoveAll(backupFolder)
+		return "", err
+	}
+	return backupFolder, nil
+}
+
+// restoreContainer puts the old container copy and certificate back into the output folder
+// and, unless params.SkipStore is set, installs the container and links the certificate.
+func restoreContainer(info *ContainerInfo, backupFolder string, params *Params) error {
+	cm := cades.CadesManager{}
+	outputFolder := containerOutputFolder(params, info.Name)
+
+	containerFolderPath := filepath.Join(outputFolder, info.ContainerFolder)
+	os.RemoveAll(containerFolderPath)
+	err := cp.Copy(filepath.Join(backupFolder, info.ContainerFolder), containerFolderPath)
+	if err != nil {
+		return err
+	}
+
+	certificateName := fmt.Sprintf("%s.cer", info.Name)
+	certificatePath := filepath.Join(outputFolder, certificateName)
+	err = cp.Copy(filepath.Join(backupFolder, certificateName), certificatePath)
+	if err != nil {
+		return err
+	}
+
+	if *params.SkipStore {
+		return nil
+	}
+
+	containersRoot, err := GetContainersRoot()
+	if err != nil {
+		return err
+	}
+
+	container, err := cm.InstallContainerFromFolder(containerFolderPath, containersRoot, "", info.Name)
+	if err != nil && !errors.Is(err, cades.ErrContainerExists) {
+		return err
+	}
+	if container == nil {
+		container, err = cm.GetContainer(info.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = cm.LinkCertWithContainer(certificatePath, container.ContainerName)
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// logCRLReport prints the downloaded CRLs with their next update time.
+func logCRLReport(crls []CRLInfo) {
+	for _, crl := range crls {
+		slog.Info(fmt.Sprintf("CRL[%s] issuer: %s, delta: %t, next update: %s", crl.File, crl.Issuer, crl.Delta, crl.NextUpdate.Local().Format(time.DateTime)))
+	}
+}
+
+// logReport prints the summary of the run, one line per container.
+func logReport(containersInfo []ContainerInfo) {
+	slog.Info(fmt.Sprintf("Report: %d containers", len(containersInfo)))
+	for _, info := range containersInfo {
+		if info.Name == "" {
+			continue
+		}
+
+		status := info.Status
+		if status == "" {
+			status = CAStatusIssued
+			if info.Thumbprint == "" {
+				status = CAStatusUnknown
+			}
+		}
+
+		attempts := info.Attempts
+		if attempts == 0 {
+			attempts = 1
+		}
+		if info.Error != nil {
+			slog.Info(fmt.Sprintf("Container[%s] status: %s, attempts: %d, error: %s", info.Name, status, attempts, info.Error.Error()))
+			continue
+		}
+		slog.Info(fmt.Sprintf("Container[%s] status: %s, thumbprint: %s, attempts: %d", info.Name, status, info.Thumbprint, attempts))
+	}
+}
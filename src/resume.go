@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	cades "github.com/Demetrous-fd/CryptoPro-Adapter"
+	"golang.org/x/exp/slog"
+)
+
+func loadContainersInfo(path string) ([]ContainerInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var containersInfo []ContainerInfo
+	err = json.Unmarshal(data, &containersInfo)
+	if err != nil {
+		return nil, err
+	}
+	return containersInfo, nil
+}
+
+// runResume downloads certificates for pending requests recorded in info.json
+// and installs them into the containers created by the previous run.
+func runResume() {
+	config, err := loadCommandConfig(*csrFileFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	infoPath := filepath.Join(config.Params.OutputFolder, "info.json")
+	containersInfo, err := loadContainersInfo(infoPath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant read file: %s, error: %s", infoPath, err.Error()))
+		return
+	}
+
+	cadesLocal, err := cades.NewCades()
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	defer cadesLocal.Close()
+
+	pool := newCAPool(cadesLocal, &config.Params, false)
+	x509 := cades.CreateX509EnrollmentRoot(cadesLocal)
+
+	for index := range containersInfo {
+		info := &containersInfo[index]
+		if info.Status != CAStatusPending || info.RequestId == "" {
+			continue
+		}
+
+		ca, params, err := pool.ResolveInfo(info)
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant resolve params, container[%s], error: %s", info.Name, err.Error()))
+			continue
+		}
+
+		ResumeCsrInstall(x509, ca, info, params)
+	}
+
+	err = saveContainersInfo(infoPath, containersInfo)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+
+	logReport(containersInfo)
+}
+
+func ResumeCsrInstall(x509 *cades.X509EnrollmentRoot, ca CA, info *ContainerInfo, params *Params) {
+	cm := cades.CadesManager{}
+	outputFolder := containerOutputFolder(params, info.Name)
+
+	csrFilePath := filepath.Join(outputFolder, fmt.Sprintf("%s.csr", info.Name))
+	csrData, err := os.ReadFile(csrFilePath)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant read csr: %s, error: %s", csrFilePath, err.Error()))
+		return
+	}
+
+	if restorer, ok := ca.(PendingRestorer); ok {
+		err = restorer.RestorePending(info.RequestId, string(csrData))
+		if err != nil {
+			slog.Error(fmt.Sprintf("Cant resume request[%s], container[%s], error: %s", info.RequestId, info.Name, err.Error()))
+			return
+		}
+	}
+
+	name := fmt.Sprintf("container[%s]", info.Name)
+	var status CAStatus
+	_, err = withRetry(&params.CA.Retry, name, func() error {
+		var err error
+		status, err = ca.Status(info.RequestId)
+		return err
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant check request[%s] status, container[%s], error: %s", info.RequestId, info.Name, err.Error()))
+		return
+	}
+
+	request, err := waitCertificate(ca, name, &CARequest{Id: info.RequestId, Status: status}, &params.CA)
+	info.Status = request.Status
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant request certificate, container[%s], error: %s", info.Name, err.Error()))
+		return
+	}
+
+	if request.Status == CAStatusPending {
+		slog.Info(fmt.Sprintf("Certificate request[%s] is still pending, container[%s]", info.RequestId, info.Name))
+		return
+	}
+
+	err = checkIssuedCertificate(request.Certificate, string(csrData), info, params)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Issued certificate rejected, container[%s], error: %s", info.Name, err.Error()))
+		return
+	}
+
+	if info.Request != nil && info.Request.CsrFile != "" {
+		saveCsrFileCertificate(request.Certificate, info, outputFolder)
+		slog.Info(fmt.Sprintf("Certificate for request[%s] saved", info.Name))
+		return
+	}
+
+	container, err := cm.GetContainer(info.Name)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant get container with name: %s, error: %s", info.Name, err.Error()))
+		return
+	}
+
+	err = installIssuedCertificate(x509, request.Certificate, container, info, outputFolder, params)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant install certificate, container[%s], error: %s", info.Name, err.Error()))
+		return
+	}
+
+	slog.Info(fmt.Sprintf("Certificate for container[%s] installed", info.Name))
+}
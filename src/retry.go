@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// HTTPStatusError is returned when the CA responds with an unexpected status code.
+type HTTPStatusError struct {
+	Url        string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("request to %s failed, status_code: %d, body: %s", e.Url, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("request to %s failed, status_code: %d", e.Url, e.StatusCode)
+}
+
+// isRetryable reports whether the request may succeed when repeated: timeouts, temporary
+// and connection errors and 5xx responses are retried. TLS, url and proxy errors are final.
+func isRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	if isNotConnected(err) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// isSubmitRetryable is isRetryable for requests the CA must not receive twice, like a csr submit.
+// Only errors raised before the request reached the CA are retried, a timeout or a reset
+// connection may come after the CA has already registered the request.
+func isSubmitRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusServiceUnavailable
+	}
+	return isNotConnected(err)
+}
+
+// isNotConnected reports errors of connecting to the server, the request itself was not sent.
+func isNotConnected(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// withRetry calls fn until it succeeds, fails with a non retryable error or params.Attempts run out.
+// The delay between attempts doubles up to params.MaxBackoff. Returns the number of attempts made.
+func withRetry(params *RetryParams, name string, fn func() error) (int, error) {
+	return withRetryIf(params, name, isRetryable, fn)
+}
+
+// withRetryIf is withRetry with the retryable check given by the caller.
+func withRetryIf(params *RetryParams, name string, retryable func(err error) bool, fn func() error) (int, error) {
+	attempts := 1
+	if params.Attempts != nil && *params.Attempts > 1 {
+		attempts = *params.Attempts
+	}
+
+	var delay, maxDelay time.Duration
+	if params.Backoff != nil {
+		delay = params.Backoff.Duration
+	}
+	if params.MaxBackoff != nil {
+		maxDelay = params.MaxBackoff.Duration
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return attempt, err
+		}
+
+		slog.Warn(fmt.Sprintf("Attempt %d/%d failed, %s, retry in %s, error: %s", attempt, attempts, name, delay, err.Error()))
+		time.Sleep(delay)
+
+		delay *= 2
+		if maxDelay > 0 && delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// rateLimiter spaces out requests to one host so no more than rate requests are sent per second.
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// rateLimiters are shared by all http clients of the run, CA clients, per-request CAs and CRL
+// downloads to the same host take turns in one limiter. The first rate set for a host is used.
+var (
+	rateLimitersLock sync.Mutex
+	rateLimiters     = map[string]*rateLimiter{}
+)
+
+func hostRateLimiter(host string, rate float64) *rateLimiter {
+	rateLimitersLock.Lock()
+	defer rateLimitersLock.Unlock()
+
+	limiter, ok := rateLimiters[host]
+	if !ok {
+		limiter = &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+		rateLimiters[host] = limiter
+	}
+	return limiter
+}
+
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	wait := l.next.Sub(now)
+	if wait < 0 {
+		wait = 0
+		l.next = now
+	}
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// rateLimitTransport waits for the limiter of the request host before sending the request.
+type rateLimitTransport struct {
+	rate      float64
+	transport http.RoundTripper
+}
+
+func newRateLimitTransport(rate float64, transport http.RoundTripper) *rateLimitTransport {
+	return &rateLimitTransport{
+		rate:      rate,
+		transport: transport,
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	hostRateLimiter(strings.ToLower(request.URL.Host), t.rate).wait()
+	return t.transport.RoundTrip(request)
+}
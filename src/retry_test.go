@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	post := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://ca.lan/certsrv/certfnsh.asp", Err: err}
+	}
+	opError := func(op string, err error) error {
+		return post(&net.OpError{Op: op, Net: "tcp", Err: err})
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		submit    bool
+	}{
+		{name: "503", err: &HTTPStatusError{StatusCode: 503}, retryable: true, submit: true},
+		{name: "500", err: &HTTPStatusError{StatusCode: 500}, retryable: true, submit: false},
+		{name: "502", err: &HTTPStatusError{StatusCode: 502}, retryable: true, submit: false},
+		{name: "404", err: &HTTPStatusError{StatusCode: 404}, retryable: false, submit: false},
+		{name: "429", err: &HTTPStatusError{StatusCode: 429}, retryable: false, submit: false},
+		{name: "wrapped status", err: fmt.Errorf("submit: %w", &HTTPStatusError{StatusCode: 503}), retryable: true, submit: true},
+		{
+			name:      "connection refused",
+			err:       opError("dial", &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}),
+			retryable: true,
+			submit:    true,
+		},
+		{name: "dial timeout", err: opError("dial", os.ErrDeadlineExceeded), retryable: true, submit: true},
+		{name: "timeout after write", err: opError("read", os.ErrDeadlineExceeded), retryable: true, submit: false},
+		{name: "client timeout", err: post(context.DeadlineExceeded), retryable: true, submit: false},
+		{
+			name:      "connection reset",
+			err:       opError("read", &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}),
+			retryable: true,
+			submit:    false,
+		},
+		{
+			name:      "tls verification",
+			err:       post(&tls.CertificateVerificationError{Err: errors.New("x509: certificate signed by unknown authority")}),
+			retryable: false,
+			submit:    false,
+		},
+		{name: "unsupported scheme", err: post(errors.New(`unsupported protocol scheme "ftp"`)), retryable: false, submit: false},
+		{name: "proxy", err: opError("proxyconnect", errors.New("proxy refused")), retryable: false, submit: false},
+		{name: "ca error", err: &CAError{Status: CAStatusDenied}, retryable: false, submit: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := isRetryable(test.err); result != test.retryable {
+				t.Errorf("isRetryable(%v) = %t, expected %t", test.err, result, test.retryable)
+			}
+			if result := isSubmitRetryable(test.err); result != test.submit {
+				t.Errorf("isSubmitRetryable(%v) = %t, expected %t", test.err, result, test.submit)
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	attempts := 3
+	params := &RetryParams{Attempts: &attempts, Backoff: &Duration{time.Millisecond}}
+
+	tests := []struct {
+		name     string
+		errors   []error
+		attempts int
+		fails    bool
+	}{
+		{name: "success", errors: []error{nil}, attempts: 1},
+		{name: "retried", errors: []error{&HTTPStatusError{StatusCode: 500}, nil}, attempts: 2},
+		{name: "attempts run out", errors: []error{&HTTPStatusError{StatusCode: 500}}, attempts: 3, fails: true},
+		{name: "final error", errors: []error{&HTTPStatusError{StatusCode: 400}, nil}, attempts: 1, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			result, err := withRetry(params, test.name, func() error {
+				err := test.errors[calls%len(test.errors)]
+				calls++
+				return err
+			})
+			if (err != nil) != test.fails {
+				t.Errorf("withRetry() error = %v, expected error: %t", err, test.fails)
+			}
+			if result != test.attempts || calls != test.attempts {
+				t.Errorf("withRetry() attempts = %d, calls = %d, expected %d", result, calls, test.attempts)
+			}
+		})
+	}
+}
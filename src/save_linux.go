@@ -24,13 +24,11 @@ func SaveContainerToDisk(rootFolder, containerName string) (string, error) {
 	}
 
 	containerFolderName := CONTAINER_FOLDER.FindString(container.UniqueContainerName)
-	username, err := GetUsername()
+	containersRoot, err := GetContainersRoot()
 	if err != nil {
 		return "", err
 	}
 
-	containersRoot := fmt.Sprintf(`/var/opt/cprocsp/keys/%s`, username)
-
 	newContainerPath := filepath.Join(rootFolder, containerFolderName)
 	containerPath := filepath.Join(containersRoot, containerFolderName)
 	if _, err := os.Stat(containerPath); err != nil {
@@ -45,6 +43,15 @@ func SaveContainerToDisk(rootFolder, containerName string) (string, error) {
 	return newContainerPath, nil
 }
 
+func GetContainersRoot() (string, error) {
+	username, err := GetUsername()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`/var/opt/cprocsp/keys/%s`, username), nil
+}
+
 func GetUsername() (string, error) {
 	u, err := user.Current()
 	if nil != err {
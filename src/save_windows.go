@@ -38,12 +38,11 @@ func SaveContainerToDisk(rootFolder, containerName string) (string, error) {
 
 func SaveContainerFromFolder(rootFolder string, container *cades.Container) (string, error) {
 	containerFolderName := CONTAINER_FOLDER.FindString(container.UniqueContainerName)
-	username, err := GetUsername()
+	containersRoot, err := GetContainersRoot()
 	if err != nil {
 		return "", err
 	}
 
-	containersRoot := fmt.Sprintf(`C:\Users\%s\AppData\Local\Crypto Pro`, username)
 	newContainerPath := filepath.Join(rootFolder, containerFolderName)
 	containerPath := filepath.Join(containersRoot, containerFolderName)
 	if _, err := os.Stat(containerPath); err != nil {
@@ -170,6 +169,15 @@ func GetUserSid() (string, error) {
 	return u.Uid, nil
 }
 
+func GetContainersRoot() (string, error) {
+	username, err := GetUsername()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`C:\Users\%s\AppData\Local\Crypto Pro`, username), nil
+}
+
 func GetUsername() (string, error) {
 	u, err := user.Current()
 	if nil != err {
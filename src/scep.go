@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	SCEP_MESSAGE_CERT_REP   = "3"
+	SCEP_MESSAGE_PKCS_REQ   = "19"
+	SCEP_MESSAGE_CERT_POLL  = "20"
+	SCEP_STATUS_SUCCESS     = "0"
+	SCEP_STATUS_FAILURE     = "2"
+	SCEP_STATUS_PENDING     = "3"
+	SCEP_CAPS_POST          = "POSTPKIOperation"
+	SCEP_CAPS_SHA256        = "SHA-256"
+	SCEP_CAPS_AES           = "AES"
+	SCEP_CONTENT_CA_CERT    = "application/x-x509-ca-cert"
+	SCEP_CONTENT_CA_RA_CERT = "application/x-x509-ca-ra-cert"
+)
+
+var (
+	oidSCEPMessageType   = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPkiStatus     = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce   = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPTransactionID = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+	oidDigestSHA256      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	scepFailInfoNames    = map[string]string{
+		"0": "badAlg",
+		"1": "badMessageCheck",
+		"2": "badRequest",
+		"3": "badTime",
+		"4": "badCertId",
+	}
+)
+
+// scepTransaction keeps the transient signer of a request, it is needed
+// to decrypt the CA response and to poll pending requests.
+type scepTransaction struct {
+	key         *rsa.PrivateKey
+	signer      *x509.Certificate
+	subject     []byte
+	certificate string
+}
+
+// SCEPCA implements the SCEP client side (RFC 8894).
+// Messages are signed with a transient RSA key, the CSR itself carries the CSP key.
+type SCEPCA struct {
+	url          string
+	path         string
+	client       *http.Client
+	caps         []string
+	recipients   []*x509.Certificate
+	caCerts      []*x509.Certificate
+	transactions map[string]*scepTransaction
+}
+
+func NewSCEPCA(params *CAParams) (*SCEPCA, error) {
+	client, err := newHTTPClient(params)
+	if err != nil {
+		return nil, err
+	}
+
+	path := strings.Trim(params.SCEP.Path, "/")
+	if path == "" {
+		path = "scep"
+	}
+
+	return &SCEPCA{
+		url:          caBaseURL(params),
+		path:         path,
+		client:       client,
+		transactions: map[string]*scepTransaction{},
+	}, nil
+}
+
+func (ca *SCEPCA) endpoint(operation string, message string) string {
+	uri := fmt.Sprintf("%s/%s?operation=%s", ca.url, ca.path, operation)
+	if message != "" {
+		uri += "&message=" + url.QueryEscape(message)
+	}
+	return uri
+}
+
+func (ca *SCEPCA) get(uri string) (string, []byte, error) {
+	resp, err := ca.client.Get(uri)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed request to %s, error: %s", uri, err.Error()))
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return "", nil, &HTTPStatusError{Url: uri, StatusCode: resp.StatusCode}
+	}
+	return resp.Header.Get("Content-Type"), body, nil
+}
+
+// GetCACaps returns capabilities announced by the SCEP server.
+func (ca *SCEPCA) GetCACaps() ([]string, error) {
+	if ca.caps != nil {
+		return ca.caps, nil
+	}
+
+	_, body, err := ca.get(ca.endpoint("GetCACaps", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	ca.caps = []string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			ca.caps = append(ca.caps, line)
+		}
+	}
+	return ca.caps, nil
+}
+
+func (ca *SCEPCA) hasCap(name string) bool {
+	caps, err := ca.GetCACaps()
+	if err != nil {
+		return false
+	}
+
+	for _, value := range caps {
+		if strings.EqualFold(value, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCACert downloads the CA certificate and the RA certificates if the server uses them.
+func (ca *SCEPCA) GetCACert() ([]*x509.Certificate, error) {
+	if ca.caCerts != nil {
+		return ca.caCerts, nil
+	}
+
+	contentType, body, err := ca.get(ca.endpoint("GetCACert", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []*x509.Certificate
+	if strings.HasPrefix(contentType, SCEP_CONTENT_CA_RA_CERT) {
+		certificates, err = parsePkcs7Certificates(body)
+	} else {
+		var certificate *x509.Certificate
+		certificate, err = x509.ParseCertificate(body)
+		certificates = []*x509.Certificate{certificate}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(certificates) == 0 {
+		return nil, ErrCertificateMissing
+	}
+
+	// RA certificates are the recipients of requests, the CA itself is used when there is no RA
+	var recipients []*x509.Certificate
+	for _, certificate := range certificates {
+		if !certificate.IsCA {
+			recipients = append(recipients, certificate)
+		}
+	}
+	if len(recipients) == 0 {
+		recipients = certificates[:1]
+	}
+
+	ca.caCerts = certificates
+	ca.recipients = recipients
+	return certificates, nil
+}
+
+func (ca *SCEPCA) issuer() *x509.Certificate {
+	for _, certificate := range ca.caCerts {
+		if certificate.IsCA {
+			return certificate
+		}
+	}
+	return ca.caCerts[0]
+}
+
+func newSCEPSigner(subject []byte) (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		RawSubject:   subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, certificate, nil
+}
+
+// pkcs7EncryptLock guards pkcs7.ContentEncryptionAlgorithm, the library takes the algorithm from this package variable.
+var pkcs7EncryptLock sync.Mutex
+
+// pkcs7Encrypt encrypts content with algorithm and restores the previous package setting,
+// so concurrent requests and other users of pkcs7 are not affected.
+func pkcs7Encrypt(content []byte, recipients []*x509.Certificate, algorithm int) ([]byte, error) {
+	pkcs7EncryptLock.Lock()
+	defer pkcs7EncryptLock.Unlock()
+
+	previous := pkcs7.ContentEncryptionAlgorithm
+	pkcs7.ContentEncryptionAlgorithm = algorithm
+	defer func() {
+		pkcs7.ContentEncryptionAlgorithm = previous
+	}()
+	return pkcs7.Encrypt(content, recipients)
+}
+
+func (ca *SCEPCA) pkiMessage(messageType string, transactionId string, transaction *scepTransaction, content []byte) ([]byte, error) {
+	algorithm := pkcs7.EncryptionAlgorithmDESCBC
+	if ca.hasCap(SCEP_CAPS_AES) {
+		algorithm = pkcs7.EncryptionAlgorithmAES128CBC
+	}
+
+	envelope, err := pkcs7Encrypt(content, ca.recipients, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	signedData, err := pkcs7.NewSignedData(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if ca.hasCap(SCEP_CAPS_SHA256) {
+		signedData.SetDigestAlgorithm(oidDigestSHA256)
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidSCEPMessageType, Value: messageType},
+			{Type: oidSCEPTransactionID, Value: transactionId},
+			{Type: oidSCEPSenderNonce, Value: nonce},
+		},
+	}
+
+	err = signedData.AddSigner(transaction.signer, transaction.key, config)
+	if err != nil {
+		return nil, err
+	}
+	return signedData.Finish()
+}
+
+func (ca *SCEPCA) pkiOperation(message []byte) ([]byte, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	if ca.hasCap(SCEP_CAPS_POST) {
+		uri := ca.endpoint("PKIOperation", "")
+		resp, err = ca.client.Post(uri, "application/x-pki-message", bytes.NewReader(message))
+	} else {
+		uri := ca.endpoint("PKIOperation", base64.StdEncoding.EncodeToString(message))
+		resp, err = ca.client.Get(uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, &HTTPStatusError{Url: resp.Request.URL.String(), StatusCode: resp.StatusCode}
+	}
+	return body, nil
+}
+
+// checkSigner accepts CertRep signed by a certificate from GetCACert or issued by one of them,
+// the signature itself only proves the message matches the certificate embedded in it.
+func (ca *SCEPCA) checkSigner(signer *x509.Certificate) error {
+	if signer == nil {
+		return errors.New("CertRep has no single signer")
+	}
+	for _, certificate := range ca.caCerts {
+		if signer.Equal(certificate) || signer.CheckSignatureFrom(certificate) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("CertRep signer %s is not a CA or RA certificate from GetCACert", signer.Subject.String())
+}
+
+// certRep parses the CA answer and decrypts the issued certificate when the request succeeded.
+func (ca *SCEPCA) certRep(response []byte, transaction *scepTransaction) (CAStatus, error) {
+	p7, err := pkcs7.Parse(response)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	err = p7.Verify()
+	if err != nil {
+		return CAStatusUnknown, fmt.Errorf("invalid CertRep signature: %s", err.Error())
+	}
+	err = ca.checkSigner(p7.GetOnlySigner())
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	var messageType, pkiStatus string
+	err = p7.UnmarshalSignedAttribute(oidSCEPMessageType, &messageType)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+	if messageType != SCEP_MESSAGE_CERT_REP {
+		return CAStatusUnknown, fmt.Errorf("unexpected SCEP messageType: %s", messageType)
+	}
+
+	err = p7.UnmarshalSignedAttribute(oidSCEPPkiStatus, &pkiStatus)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	switch pkiStatus {
+	case SCEP_STATUS_PENDING:
+		return CAStatusPending, nil
+	case SCEP_STATUS_FAILURE:
+		var failInfo string
+		p7.UnmarshalSignedAttribute(oidSCEPFailInfo, &failInfo)
+		if message, ok := scepFailInfoNames[failInfo]; ok {
+			failInfo = message
+		}
+		return CAStatusDenied, fmt.Errorf("SCEP request failed, failInfo: %s", failInfo)
+	case SCEP_STATUS_SUCCESS:
+	default:
+		return CAStatusUnknown, fmt.Errorf("unexpected SCEP pkiStatus: %s", pkiStatus)
+	}
+
+	envelope, err := pkcs7.Parse(p7.Content)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	degenerate, err := envelope.Decrypt(transaction.signer, transaction.key)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	certificates, err := parsePkcs7Certificates(degenerate)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+	if len(certificates) == 0 {
+		return CAStatusUnknown, ErrCertificateMissing
+	}
+
+	certificate := certificates[0]
+	for _, item := range certificates {
+		if bytes.Equal(item.RawSubject, transaction.subject) {
+			certificate = item
+			break
+		}
+	}
+
+	transaction.certificate = derToPem(certificate.Raw)
+	return CAStatusIssued, nil
+}
+
+func (ca *SCEPCA) Submit(csr string) (*CARequest, error) {
+	_, err := ca.GetCACert()
+	if err != nil {
+		return nil, err
+	}
+
+	csrDer, err := csrToDer(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return nil, err
+	}
+
+	key, signer, err := newSCEPSigner(request.RawSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(request.RawSubjectPublicKeyInfo)
+	transactionId := hex.EncodeToString(hash[:])
+	transaction := &scepTransaction{
+		key:     key,
+		signer:  signer,
+		subject: request.RawSubject,
+	}
+
+	message, err := ca.pkiMessage(SCEP_MESSAGE_PKCS_REQ, transactionId, transaction, csrDer)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := ca.pkiOperation(message)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := ca.certRep(response, transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.transactions[transactionId] = transaction
+	return &CARequest{Id: transactionId, Status: status, Certificate: transaction.certificate}, nil
+}
+
+// RestorePending always fails, CertPoll must be signed with the transient key of the transaction,
+// which exists only during the run that sent the request.
+func (ca *SCEPCA) RestorePending(requestId string, csr string) error {
+	if _, ok := ca.transactions[requestId]; ok {
+		return nil
+	}
+	return fmt.Errorf("resume is %s: scep transaction[%s] is kept only during the run, send the request again", ErrNotSupported.Error(), requestId)
+}
+
+// SessionPending marks SCEP transactions as valid only during the run, see RestorePending.
+func (ca *SCEPCA) SessionPending() {}
+
+// Status sends CertPoll for the pending transaction.
+func (ca *SCEPCA) Status(requestId string) (CAStatus, error) {
+	transaction, ok := ca.transactions[requestId]
+	if !ok {
+		return CAStatusUnknown, ErrRequestIdNotFound
+	}
+
+	if transaction.certificate != "" {
+		return CAStatusIssued, nil
+	}
+
+	issuerAndSubject, err := asn1.Marshal(struct {
+		Issuer  asn1.RawValue
+		Subject asn1.RawValue
+	}{
+		Issuer:  asn1.RawValue{FullBytes: ca.issuer().RawSubject},
+		Subject: asn1.RawValue{FullBytes: transaction.subject},
+	})
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	message, err := ca.pkiMessage(SCEP_MESSAGE_CERT_POLL, requestId, transaction, issuerAndSubject)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	response, err := ca.pkiOperation(message)
+	if err != nil {
+		return CAStatusUnknown, err
+	}
+
+	return ca.certRep(response, transaction)
+}
+
+func (ca *SCEPCA) Certificate(requestId string) (string, error) {
+	transaction, ok := ca.transactions[requestId]
+	if !ok || transaction.certificate == "" {
+		return "", ErrCertificateMissing
+	}
+	return transaction.certificate, nil
+}
+
+func (ca *SCEPCA) Root() (string, error) {
+	certificates, err := ca.GetCACert()
+	if err != nil {
+		return "", err
+	}
+
+	for _, certificate := range certificates {
+		if bytes.Equal(certificate.RawSubject, certificate.RawIssuer) {
+			return derToPem(certificate.Raw), nil
+		}
+	}
+	return derToPem(ca.issuer().Raw), nil
+}
+
+func (ca *SCEPCA) Chain() (string, error) {
+	certificates, err := ca.GetCACert()
+	if err != nil {
+		return "", err
+	}
+
+	var raw []byte
+	for _, certificate := range certificates {
+		raw = append(raw, certificate.Raw...)
+	}
+
+	degenerate, err := pkcs7.DegenerateCertificate(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(degenerate), nil
+}
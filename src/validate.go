@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	MAX_CONTAINER_NAME_LENGTH = 255
+
+	// Bits accepted by CX509ExtensionKeyUsage.InitializeEncode
+	KEY_USAGE_FLAGS_MASK = XCN_CERT_ENCIPHER_ONLY_KEY_USAGE |
+		XCN_CERT_CRL_SIGN_KEY_USAGE |
+		XCN_CERT_KEY_CERT_SIGN_KEY_USAGE |
+		XCN_CERT_KEY_AGREEMENT_KEY_USAGE |
+		XCN_CERT_DATA_ENCIPHERMENT_KEY_USAGE |
+		XCN_CERT_KEY_ENCIPHERMENT_KEY_USAGE |
+		XCN_CERT_NON_REPUDIATION_KEY_USAGE |
+		XCN_CERT_DIGITAL_SIGNATURE_KEY_USAGE |
+		XCN_CERT_DECIPHER_ONLY_KEY_USAGE
+)
+
+var (
+	OID_PATTERN = regexp.MustCompile(`^[0-2](?:\.(?:0|[1-9]\d*))+$`)
+	// Characters not allowed in file names, container folders are named after the container
+	CONTAINER_NAME_FORBIDDEN_PATTERN = regexp.MustCompile(`[\\/:*?"<>|]`)
+)
+
+// X500_ATTRIBUTE_NAMES are the attribute names accepted by CX500DistinguishedName.Encode
+// next to OIDs, including the CryptoPro extensions for Russian qualified certificates.
+var X500_ATTRIBUTE_NAMES = map[string]bool{
+	"CN": true, "L": true, "O": true, "OU": true, "E": true, "EMAIL": true, "C": true,
+	"S": true, "ST": true, "STREET": true, "T": true, "TITLE": true,
+	"G": true, "GN": true, "GIVENNAME": true, "I": true, "INITIALS": true, "SN": true,
+	"DC": true, "SERIALNUMBER": true, "DESCRIPTION": true, "POSTALCODE": true, "POBOX": true,
+	"PHONE": true, "X21ADDRESS": true, "DNQUALIFIER": true,
+	"UNSTRUCTUREDNAME": true, "UNSTRUCTUREDADDRESS": true, "DEVICESERIALNUMBER": true,
+	"INN": true, "INNLE": true, "OGRN": true, "OGRNIP": true, "SNILS": true,
+}
+
+// KEY_SPEC_VALUES are AT_KEYEXCHANGE and AT_SIGNATURE.
+var KEY_SPEC_VALUES = map[int]bool{1: true, 2: true}
+
+// KEY_PROTECTION_VALUES are the X509PrivateKeyProtection values: none, protect and force high protection.
+var KEY_PROTECTION_VALUES = map[int]bool{0: true, 1: true, 2: true}
+
+// isOid checks the dotted form of an object identifier, the second arc is below 40 for the first two roots.
+func isOid(value string) bool {
+	if !OID_PATTERN.MatchString(value) {
+		return false
+	}
+
+	arcs := strings.Split(value, ".")
+	if arcs[0] == "2" {
+		return true
+	}
+	second, err := strconv.Atoi(arcs[1])
+	return err == nil && second < 40
+}
+
+// validateConfig checks the config without the CSP and the CA and returns the found problems,
+// each prefixed with the path of the field, e.g. requests[0].dn.XX.
+func validateConfig(config *Config) []string {
+	var problems []string
+	add := func(path string, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	validateCAType("params.ca.type", config.Params.CA.Type, add)
+
+	names := map[string]int{}
+	for index := range config.Requests {
+		csr := &config.Requests[index]
+		path := fmt.Sprintf("requests[%d]", index)
+
+		if len(csr.CA) > 0 {
+			caParams, err := mergeCAParams(&config.Params.CA, csr.CA)
+			if err != nil {
+				add(fmt.Sprintf("%s.ca", path), "%s", err.Error())
+			} else {
+				validateCAType(fmt.Sprintf("%s.ca.type", path), caParams.Type, add)
+			}
+		}
+
+		if csr.CsrFile == "" {
+			validateDn(fmt.Sprintf("%s.dn", path), csr.Dn, add)
+		}
+
+		for i, oid := range csr.ExtensionEKU {
+			if !isOid(oid) {
+				add(fmt.Sprintf("%s.extensionEKU[%d]", path, i), "invalid OID %q", oid)
+			}
+		}
+
+		for _, oid := range sortedKeys(csr.SAN) {
+			if !isOid(oid) {
+				add(fmt.Sprintf("%s.san", path), "invalid OID %q", oid)
+			}
+			for i, value := range csr.SAN[oid] {
+				if value == "" {
+					add(fmt.Sprintf("%s.san.%s[%d]", path, oid, i), "empty value")
+				}
+			}
+		}
+
+		if csr.EKUKeyUsageFlags != nil {
+			flags := *csr.EKUKeyUsageFlags
+			if flags <= 0 || flags&^KEY_USAGE_FLAGS_MASK != 0 {
+				add(fmt.Sprintf("%s.ekuKeyUsageFlags", path), "invalid key usage bitmask 0x%X, allowed bits 0x%X", flags, KEY_USAGE_FLAGS_MASK)
+			}
+		}
+
+		containerPath := fmt.Sprintf("%s.container", path)
+		if name := csr.Container.Name; name != "" {
+			if length := utf8.RuneCountInString(name); length > MAX_CONTAINER_NAME_LENGTH {
+				add(containerPath+".name", "name is %d characters long, maximum %d", length, MAX_CONTAINER_NAME_LENGTH)
+			}
+			if match := CONTAINER_NAME_FORBIDDEN_PATTERN.FindString(name); match != "" {
+				add(containerPath+".name", "forbidden character %q", match)
+			}
+			if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+				add(containerPath+".name", "control characters are not allowed")
+			}
+			if strings.TrimSpace(name) != name {
+				add(containerPath+".name", "leading or trailing spaces are not allowed")
+			}
+		}
+		if csr.Container.KeySpec != nil && !KEY_SPEC_VALUES[*csr.Container.KeySpec] {
+			add(containerPath+".keySpec", "invalid value %d, expected 1 (AT_KEYEXCHANGE) or 2 (AT_SIGNATURE)", *csr.Container.KeySpec)
+		}
+		if csr.Container.KeyProtection != nil && !KEY_PROTECTION_VALUES[*csr.Container.KeyProtection] {
+			add(containerPath+".keyProtection", "invalid value %d, expected 0, 1 or 2", *csr.Container.KeyProtection)
+		}
+
+		name := csr.Container.Name
+		if csr.CsrFile != "" {
+			name = csrFileName(csr)
+		}
+		if name == "" {
+			continue
+		}
+		if first, ok := names[strings.ToLower(name)]; ok {
+			add(containerPath+".name", "duplicate name %q, already used by requests[%d]", name, first)
+			continue
+		}
+		names[strings.ToLower(name)] = index
+	}
+	return problems
+}
+
+func validateCAType(path string, caType *string, add func(path string, format string, args ...any)) {
+	if caType == nil {
+		return
+	}
+	switch *caType {
+	case "", CATypeCertsrv, CATypeEST, CATypeSCEP, CATypeLocal:
+	default:
+		add(path, "unknown CA type %q", *caType)
+	}
+}
+
+func validateDn(path string, dn map[string]string, add func(path string, format string, args ...any)) {
+	if len(dn) == 0 {
+		add(path, "dn is empty")
+		return
+	}
+
+	for _, name := range sortedKeys(dn) {
+		if !isOid(name) && !X500_ATTRIBUTE_NAMES[strings.ToUpper(name)] {
+			add(fmt.Sprintf("%s.%s", path, name), "unknown attribute name, use a known name (CN, O, OU, ...) or an OID")
+		}
+		if strings.TrimSpace(dn[name]) == "" {
+			add(fmt.Sprintf("%s.%s", path, name), "empty value")
+		}
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkConfig logs the validation problems and reports whether the config is valid.
+func checkConfig(config *Config) bool {
+	problems := validateConfig(config)
+	for _, problem := range problems {
+		slog.Error(fmt.Sprintf("Invalid config, %s", problem))
+	}
+	return len(problems) == 0
+}
+
+// runValidate checks the config from -file and reports whether it is valid.
+func runValidate() bool {
+	config, err := loadConfig(*csrFileFlag)
+	if err != nil {
+		slog.Error(err.Error())
+		return false
+	}
+
+	err = expandRequests(config)
+	if err != nil {
+		slog.Error(fmt.Sprintf("Cant expand requests, error: %s", err.Error()))
+		return false
+	}
+
+	if !checkConfig(config) {
+		return false
+	}
+	slog.Info(fmt.Sprintf("Config %s is valid, requests: %d", *csrFileFlag, len(config.Requests)))
+	return true
+}
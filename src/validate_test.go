@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name:   "valid",
+			config: `{"params": {"ca": {"type": "certsrv"}}, "requests": [{"container": {"name": "TEST_1", "keySpec": 2, "keyProtection": 1}, "dn": {"CN": "Test", "1.2.643.100.3": "00000000000"}}]}`,
+		},
+		{
+			name:     "unknown ca type",
+			config:   `{"params": {"ca": {"type": "acme"}}, "requests": [{"dn": {"CN": "Test"}}]}`,
+			expected: `params.ca.type: unknown CA type "acme"`,
+		},
+		{
+			name:     "unknown request ca type",
+			config:   `{"requests": [{"ca": {"type": "acme"}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].ca.type: unknown CA type "acme"`,
+		},
+		{
+			name:     "broken request ca",
+			config:   `{"requests": [{"ca": {"type": 1}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].ca: `,
+		},
+		{
+			name:     "empty dn",
+			config:   `{"requests": [{"dn": {}}]}`,
+			expected: `requests[0].dn: dn is empty`,
+		},
+		{
+			name:     "unknown dn attribute",
+			config:   `{"requests": [{"dn": {"XX": "Test"}}]}`,
+			expected: `requests[0].dn.XX: unknown attribute name`,
+		},
+		{
+			name:     "empty dn value",
+			config:   `{"requests": [{"dn": {"CN": " "}}]}`,
+			expected: `requests[0].dn.CN: empty value`,
+		},
+		{
+			name:     "invalid eku",
+			config:   `{"requests": [{"extensionEKU": ["1.3.6.1.5.5.7.3.2", "1.50.1"], "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].extensionEKU[1]: invalid OID "1.50.1"`,
+		},
+		{
+			name:     "invalid san oid",
+			config:   `{"requests": [{"san": {"email": ["user@ca.lan"]}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].san: invalid OID "email"`,
+		},
+		{
+			name:     "empty san value",
+			config:   `{"requests": [{"san": {"2.5.29.17": ["user@ca.lan", ""]}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].san.2.5.29.17[1]: empty value`,
+		},
+		{
+			name:     "key usage flags",
+			config:   `{"requests": [{"ekuKeyUsageFlags": 65536, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].ekuKeyUsageFlags: invalid key usage bitmask 0x10000`,
+		},
+		{
+			name:     "long container name",
+			config:   `{"requests": [{"container": {"name": "` + strings.Repeat("я", MAX_CONTAINER_NAME_LENGTH+1) + `"}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].container.name: name is 256 characters long, maximum 255`,
+		},
+		{
+			name:     "forbidden character",
+			config:   `{"requests": [{"container": {"name": "TEST/1"}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].container.name: forbidden character "/"`,
+		},
+		{
+			name:     "control character",
+			config:   `{"requests": [{"container": {"name": "TEST\t1"}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].container.name: control characters are not allowed`,
+		},
+		{
+			name:     "trailing space",
+			config:   `{"requests": [{"container": {"name": "TEST "}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].container.name: leading or trailing spaces are not allowed`,
+		},
+		{
+			name:     "key spec",
+			config:   `{"requests": [{"container": {"keySpec": 3}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].container.keySpec: invalid value 3`,
+		},
+		{
+			name:     "key protection",
+			config:   `{"requests": [{"container": {"keyProtection": 3}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[0].container.keyProtection: invalid value 3`,
+		},
+		{
+			name:     "duplicate name",
+			config:   `{"requests": [{"container": {"name": "TEST"}, "dn": {"CN": "Test"}}, {"container": {"name": "test"}, "dn": {"CN": "Test"}}]}`,
+			expected: `requests[1].container.name: duplicate name "test", already used by requests[0]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := initConfig([]byte(test.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			problems := validateConfig(config)
+			if test.expected == "" {
+				if len(problems) != 0 {
+					t.Errorf("validateConfig() = %q, expected no problems", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.HasPrefix(problems[0], test.expected) {
+				t.Errorf("validateConfig() = %q, expected one problem %q", problems, test.expected)
+			}
+		})
+	}
+}
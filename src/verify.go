@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionSubjectAltName   = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+
+	ErrPublicKeyMismatch = errors.New("certificate public key does not match the csr")
+	ErrChainMismatch     = errors.New("certificate does not chain to the CA root")
+)
+
+// verifyCertificate checks the issued certificate against the csr before it is installed.
+// A certificate that cannot be parsed, has another public key or does not chain to the downloaded root is an error.
+// Differences in subject and extensions are returned as a diff, one line per mismatch.
+func verifyCertificate(certificateData string, csrData string, params *Params) ([]string, error) {
+	certificate, err := parseCertificate([]byte(certificateData))
+	if err != nil {
+		return nil, fmt.Errorf("cant parse issued certificate: %s", err.Error())
+	}
+
+	csrDer, err := csrToDer(csrData)
+	if err != nil {
+		return nil, fmt.Errorf("cant decode csr: %s", err.Error())
+	}
+	request, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return nil, fmt.Errorf("cant parse csr: %s", err.Error())
+	}
+
+	if !samePublicKey(certificate.RawSubjectPublicKeyInfo, request.RawSubjectPublicKeyInfo) {
+		return nil, ErrPublicKeyMismatch
+	}
+
+	err = verifyChain(certificate, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff []string
+	diff = append(diff, subjectDiff(request, certificate)...)
+	diff = append(diff, extensionsDiff(request, certificate)...)
+	return diff, nil
+}
+
+// samePublicKey compares only the key itself, CAs may encode GOST key parameters differently.
+func samePublicKey(certificateSpki []byte, csrSpki []byte) bool {
+	var certificateKey, csrKey subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(certificateSpki, &certificateKey); err != nil {
+		return false
+	}
+	if _, err := asn1.Unmarshal(csrSpki, &csrKey); err != nil {
+		return false
+	}
+	return bytes.Equal(certificateKey.PublicKey.Bytes, csrKey.PublicKey.Bytes)
+}
+
+// verifyChain looks for the path from the certificate to the root saved by InstallRoot through chain.p7b.
+// Signatures are checked when Go supports the algorithm, GOST chains are matched by names only.
+func verifyChain(certificate *x509.Certificate, params *Params) error {
+	rootData, err := os.ReadFile(rootCertificatePath(params))
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Root certificate is not available, skip chain verification, error: %s", err.Error()))
+		return nil
+	}
+
+	root, err := parseCertificate(rootData)
+	if err != nil {
+		return fmt.Errorf("cant parse root certificate: %s", err.Error())
+	}
+
+	var intermediates []*x509.Certificate
+	chainData, err := os.ReadFile(chainPath(params))
+	if err == nil {
+		intermediates, _ = parsePkcs7Certificates(chainData)
+	}
+
+	current := certificate
+	for depth := 0; depth < 10; depth++ {
+		if bytes.Equal(current.RawIssuer, root.RawSubject) {
+			return checkSignature(current, root)
+		}
+
+		var parent *x509.Certificate
+		for _, candidate := range intermediates {
+			if bytes.Equal(current.RawIssuer, candidate.RawSubject) && !bytes.Equal(candidate.Raw, current.Raw) {
+				parent = candidate
+				break
+			}
+		}
+		if parent == nil {
+			break
+		}
+
+		err = checkSignature(current, parent)
+		if err != nil {
+			return err
+		}
+		current = parent
+	}
+	return fmt.Errorf("%w: issuer %s, root %s", ErrChainMismatch, certificate.Issuer.String(), root.Subject.String())
+}
+
+// isSelfSigned reports whether the certificate is issued by itself. Signatures Go cannot check (GOST)
+// are inconclusive, then equal subject and issuer with matching key ids are enough.
+func isSelfSigned(certificate *x509.Certificate) bool {
+	return bytes.Equal(certificate.RawSubject, certificate.RawIssuer) && checkSignature(certificate, certificate) == nil
+}
+
+func checkSignature(certificate *x509.Certificate, parent *x509.Certificate) error {
+	if len(certificate.AuthorityKeyId) > 0 && len(parent.SubjectKeyId) > 0 && !bytes.Equal(certificate.AuthorityKeyId, parent.SubjectKeyId) {
+		return fmt.Errorf("%w: authority key id %X, issuer key id %X", ErrChainMismatch, certificate.AuthorityKeyId, parent.SubjectKeyId)
+	}
+
+	err := parent.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature)
+	if err != nil && !errors.Is(err, x509.ErrUnsupportedAlgorithm) {
+		return fmt.Errorf("%w: %s", ErrChainMismatch, err.Error())
+	}
+	return nil
+}
+
+// subjectDiff reports requested subject attributes missing or changed in the certificate.
+func subjectDiff(request *x509.CertificateRequest, certificate *x509.Certificate) []string {
+	issued := map[string][]string{}
+	for _, attribute := range certificate.Subject.Names {
+		oid := attribute.Type.String()
+		issued[oid] = append(issued[oid], fmt.Sprint(attribute.Value))
+	}
+
+	var diff []string
+	for _, attribute := range request.Subject.Names {
+		oid := attribute.Type.String()
+		value := fmt.Sprint(attribute.Value)
+
+		values, ok := issued[oid]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("subject %s: requested %q, issued none", oid, value))
+			continue
+		}
+
+		found := false
+		for _, issuedValue := range values {
+			if issuedValue == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, fmt.Sprintf("subject %s: requested %q, issued %q", oid, value, strings.Join(values, ", ")))
+		}
+	}
+	return diff
+}
+
+// extensionsDiff compares key usage, extended key usage and subject alternative name requested in the csr.
+func extensionsDiff(request *x509.CertificateRequest, certificate *x509.Certificate) []string {
+	issued := map[string][]byte{}
+	for _, extension := range certificate.Extensions {
+		issued[extension.Id.String()] = extension.Value
+	}
+
+	var diff []string
+	for _, extension := range request.Extensions {
+		var name string
+		switch {
+		case extension.Id.Equal(oidExtensionKeyUsage):
+			name = "key usage"
+		case extension.Id.Equal(oidExtensionExtendedKeyUsage):
+			name = "extended key usage"
+		case extension.Id.Equal(oidExtensionSubjectAltName):
+			name = "subject alternative name"
+		default:
+			continue
+		}
+
+		value, ok := issued[extension.Id.String()]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("%s: requested %s, issued none", name, formatExtension(extension.Id, extension.Value)))
+			continue
+		}
+		if !bytes.Equal(value, extension.Value) {
+			diff = append(diff, fmt.Sprintf("%s: requested %s, issued %s", name, formatExtension(extension.Id, extension.Value), formatExtension(extension.Id, value)))
+		}
+	}
+	return diff
+}
+
+// formatExtension renders the extension value for the diff, EKU as sorted OIDs and the rest as hex.
+func formatExtension(id asn1.ObjectIdentifier, value []byte) string {
+	if id.Equal(oidExtensionExtendedKeyUsage) {
+		var oids []asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(value, &oids); err == nil {
+			names := make([]string, 0, len(oids))
+			for _, oid := range oids {
+				names = append(names, oid.String())
+			}
+			sort.Strings(names)
+			return fmt.Sprintf("[%s]", strings.Join(names, ", "))
+		}
+	}
+
+	if id.Equal(oidExtensionKeyUsage) {
+		var usage asn1.BitString
+		if _, err := asn1.Unmarshal(value, &usage); err == nil {
+			flags := 0
+			for i := 0; i < usage.BitLength && i < 8; i++ {
+				if usage.At(i) != 0 {
+					flags |= 0x80 >> i
+				}
+			}
+			return fmt.Sprintf("0x%02X", flags)
+		}
+	}
+	return hex.EncodeToString(value)
+}